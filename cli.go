@@ -0,0 +1,175 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"gosec/softether"
+)
+
+// Exit codes of gosec connect
+const (
+	exitOK        = 0
+	exitConn      = 1 // failed to connect, or reconnect refused
+	exitUsage     = 2 // bad flags, as package flag does
+	exitAuth      = 3 // user name, password or client certificate refused
+	exitPerm      = 4 // TAP interface can't be created, not root
+	exitUntrusted = 5 // server certificate not trusted or not pinned
+)
+
+// passwordEnv is the environment variable of the password, when no
+// -password-file given
+const passwordEnv = "GOSEC_PASSWORD"
+
+// cliMain runs "gosec connect" with args, which connects without a window
+// and prints the state as it changes, until interrupted. It returns the exit
+// code.
+func cliMain(args []string) int {
+	defer closeLogFd()
+	var c vpnSetting
+
+	fs := flag.NewFlagSet("gosec connect", flag.ContinueOnError)
+	var host = fs.String("host", "", "server host or host:port, port 443 if not given")
+	var usr = fs.String("user", "", "user name, may be user@hub or hub\\user")
+	var passwdFile = fs.String("password-file", "", "file of the password on its first line, else $"+passwordEnv+", else prompted")
+	applyDebug := debugFlags(fs, "loghost")
+	applySettings := c.settingFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gosec connect -host host[:port] -user user [flags]\n"+
+			"       gosec connect -profile name [flags]\n\n"+
+			"Exit codes: %d disconnected by signal, %d connection failed, %d bad flags,\n"+
+			"%d login refused, %d not root, %d server certificate not trusted\n\n",
+			exitOK, exitConn, exitUsage, exitAuth, exitPerm, exitUntrusted)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	applyDebug()
+	if err := applySettings(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if *host != "" {
+		c.host = *host
+	}
+	if *usr != "" {
+		c.usr = *usr
+	}
+	if c.host == "" || (!c.anonymous && c.usr == "") || fs.NArg() != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	// the password of a profile, or the hash of one imported from a .vpn
+	// file, is kept in the secret store
+	stored := c.passwd != "" || (c.authType == softether.AuthPassword && c.hashedPasswd != nil)
+	if !c.anonymous && (!stored || *passwdFile != "") {
+		var err error
+		if c.passwd, err = cliPassword(*passwdFile, c.authType == softether.AuthCert); err != nil {
+			fmt.Fprintln(os.Stderr, "password:", err)
+			return exitUsage
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		s := <-sig
+		cliPrint("%v, disconnecting", s)
+		cancel()
+	}()
+
+	var last string
+	c.onChange = func() {
+		if status := c.status(); status != last {
+			last = status
+			cliPrint("%s", status)
+		}
+	}
+	c.connState = nConnecting
+	c.changed()
+	c.startConnect(ctx)
+	cancel()
+
+	switch c.err {
+	case eNone:
+		return exitOK
+	case ePsw, eCert:
+		return exitAuth
+	case ePerm:
+		return exitPerm
+	case eUntrusted, ePin:
+		if u := c.untrusted; u != nil {
+			if u.Changed {
+				cliPrint("WARNING: the certificate has CHANGED!")
+			}
+			cliPrint("%s of %s, issued by %s", u.Cert.Subject.CommonName, u.HostPort, u.Cert.Issuer.CommonName)
+			cliPrint("to trust it, connect with -pin %s", u.Fingerprint)
+		}
+		return exitUntrusted
+	}
+	return exitConn
+}
+
+// cliPrint prints a line of status with the time
+func cliPrint(format string, args ...interface{}) {
+	fmt.Printf(time.Now().Format("15:04:05 ")+format+"\n", args...)
+}
+
+// cliPassword reads the password from file if given, or passwordEnv, or
+// else prompts for it. A passphrase of a key may be empty.
+func cliPassword(file string, passphrase bool) (string, error) {
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(strings.SplitN(string(data), "\n", 2)[0], "\r"), nil
+	}
+	if passwd, ok := os.LookupEnv(passwordEnv); ok {
+		return passwd, nil
+	}
+
+	prompt := "Password: "
+	if passphrase {
+		prompt = "Passphrase of key (empty if none): "
+	}
+	var passwd string
+	if fd := int(os.Stdin.Fd()); terminal.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		data, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		passwd = string(data)
+	} else {
+		// piped in
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		passwd = strings.TrimRight(line, "\r\n")
+	}
+	if passwd == "" && !passphrase {
+		return "", errors.New("empty")
+	}
+	return passwd, nil
+}
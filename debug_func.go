@@ -7,7 +7,15 @@ package main
 import (
 	"crypto/tls"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"gosec/softether"
 )
 
 /* four kinds of log functions:
@@ -20,23 +28,86 @@ func nullPrintf(format string, args ...interface{}) {
 }
 
 func fmtPrintf(format string, args ...interface{}) {
-	fmt.Printf(format, args...)
+	fmt.Fprintf(debugOut, format, args...)
 }
 
 func logPrintf(format string, args ...interface{}) {
 	log.Printf(format, args...)
 }
 
+// debugOut is where print writes, debugErr where the failure to reach
+// logServer is told, log writes to its own output
+var debugOut io.Writer = os.Stdout
+var debugErr io.Writer = os.Stderr
+
+// debugAway sends the debug output away from the terminal the text UI draws
+// on: to stderr if it is redirected, else to the file at path, created when
+// first written
+func debugAway(path string) {
+	var w io.Writer = os.Stderr
+	if terminal.IsTerminal(int(os.Stderr.Fd())) {
+		w = &debugFile{path: path}
+	}
+	debugOut, debugErr = w, w
+	log.SetOutput(w)
+}
+
+// debugFile appends to the file at path, nothing is written if it can't be
+// opened
+type debugFile struct {
+	path string
+	once sync.Once
+	mu   sync.Mutex
+	f    *os.File
+}
+
+func (d *debugFile) Write(p []byte) (int, error) {
+	d.once.Do(func() {
+		if d.path == "" {
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(d.path), 0700); err != nil {
+			return
+		}
+		d.f, _ = os.OpenFile(d.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	})
+	if d.f == nil {
+		return len(p), nil
+	}
+	// Debug is called from many goroutines
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.f.Write(p)
+}
+
 var logFd *tls.Conn
 var logServer string
 
+// logTrust verifies the certificate of logServer, by the system roots unless
+// a CA or fingerprint of its self-signed certificate is given
+var logTrust softether.Trust
+
+// logDialFailed is set once the failure to reach logServer is told
+var logDialFailed bool
+
 func sendToLogServer(format string, args ...interface{}) {
 	if logFd == nil {
 		// has to explict declare err instead of shorthand otherwise global logFd is NULL
 		var err error = nil
-		logFd, err = tls.Dial("tcp", logServer, &tls.Config{InsecureSkipVerify: true})
+		var config *tls.Config
+		config, err = logTrust.TLSConfig(softether.ServerName(logServer))
+		if err == nil {
+			logFd, err = tls.Dial("tcp", logServer, config)
+		}
 		if err != nil {
-			_ = logFd
+			logFd = nil
+			if !logDialFailed {
+				logDialFailed = true
+				fmt.Fprintf(debugErr, "logserver %s: %v\n", logServer, err)
+				if _, ok := err.(*softether.UntrustedCert); ok {
+					fmt.Fprintln(debugErr, "give its fingerprint by -logpin, or its CA by -logca")
+				}
+			}
 			return
 		}
 	}
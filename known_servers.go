@@ -0,0 +1,75 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configPath is the path of file name in the config directory of gosec,
+// empty if there is no home directory
+func configPath(name string) string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "gosec", name)
+}
+
+// knownServersPath is the file of fingerprints trusted on first use, one
+// "host:port fingerprint" a line, like known_hosts of ssh
+func knownServersPath() string {
+	return configPath("known_servers")
+}
+
+// loadKnownServer returns the fingerprint trusted for hostport, if any
+func loadKnownServer(hostport string) string {
+	f, err := os.Open(knownServersPath())
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == hostport {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// saveKnownServer remembers fingerprint as trusted for hostport, replacing
+// the one trusted before
+func saveKnownServer(hostport, fingerprint string) error {
+	path := knownServersPath()
+	if path == "" {
+		return errors.New("no home directory for known servers")
+	}
+	var lines []string
+	if data, err := ioutil.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 || fields[0] == hostport {
+				continue
+			}
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, hostport+" "+fingerprint)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
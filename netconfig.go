@@ -0,0 +1,136 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"net"
+
+	"github.com/u-root/u-root/pkg/dhclient"
+	"github.com/vishvananda/netlink"
+)
+
+const resolvConf = "/etc/resolv.conf"
+
+// netConfig is what configuring a lease changes in the system, to restore
+// when the tunnel is closed
+type netConfig struct {
+	link netlink.Link
+	// default routes before, the lease may replace them
+	routes []netlink.Route
+	// DNS settings before, nil if none
+	resolv []byte
+}
+
+// configureLease gets an address for the interface name by DHCP and
+// configures it, until ctx is done
+func configureLease(ctx context.Context, name string) *netConfig {
+	ctx, cancel := context.WithTimeout(ctx, dhcpTries*dhcpTimeout)
+	defer cancel()
+
+	var filteredIfs []netlink.Link
+	ifs, _ := netlink.LinkList()
+	for _, iface := range ifs {
+		if name == iface.Attrs().Name {
+			filteredIfs = append(filteredIfs, iface)
+			break
+		}
+	}
+	if len(filteredIfs) == 0 {
+		Debug("no interface %s\n", name)
+		return nil
+	}
+
+	n := &netConfig{link: filteredIfs[0]}
+	routes, _ := netlink.RouteList(nil, netlink.FAMILY_V4)
+	for _, r := range routes {
+		if r.Dst == nil && r.LinkIndex != n.link.Attrs().Index {
+			n.routes = append(n.routes, r)
+		}
+	}
+	n.resolv, _ = ioutil.ReadFile(resolvConf)
+
+	r := dhclient.SendRequests(ctx, filteredIfs, dhcpTimeout, dhcpTries, true, false)
+	if r == nil {
+		Debug("r is null\n")
+		return n
+	}
+	// After result back, dhclient will close chan r immediately.
+	result := <-r
+	if nil != result && result.Err == nil {
+		Debug("result %v\n", result)
+		result.Lease.Configure()
+	}
+	return n
+}
+
+// releaseLease tells the DHCP server the address of the lease is free, if
+// the tunnel is still up. The server is taken as the gateway of the lease,
+// which it is for SecureNAT, the usual DHCP server of a hub.
+func (n *netConfig) releaseLease() {
+	addrs, err := netlink.AddrList(n.link, netlink.FAMILY_V4)
+	if err != nil || len(addrs) == 0 {
+		return
+	}
+	routes, err := netlink.RouteList(n.link, netlink.FAMILY_V4)
+	if err != nil {
+		return
+	}
+	for _, r := range routes {
+		if r.Dst != nil || r.Gw == nil {
+			continue
+		}
+		ip := addrs[0].IP
+		conn, err := net.DialUDP("udp4", &net.UDPAddr{IP: ip, Port: 68}, &net.UDPAddr{IP: r.Gw, Port: 67})
+		if err != nil {
+			Debug("err: %v\n", err)
+			return
+		}
+		_, err = conn.Write(dhcpRelease(ip, r.Gw, n.link.Attrs().HardwareAddr))
+		conn.Close()
+		Debug("DHCP release of %v to %v: %v\n", ip, r.Gw, err)
+		return
+	}
+}
+
+// dhcpRelease is a DHCPRELEASE of ip leased to mac by server
+func dhcpRelease(ip, server net.IP, mac net.HardwareAddr) []byte {
+	p := make([]byte, 240)
+	p[0] = 1 // BOOTREQUEST
+	p[1] = 1 // ethernet
+	p[2] = byte(len(mac))
+	binary.BigEndian.PutUint32(p[4:], rand.Uint32()) // xid
+	copy(p[12:16], ip.To4())                         // ciaddr
+	copy(p[28:44], mac)                              // chaddr
+	copy(p[236:], []byte{99, 130, 83, 99})           // magic cookie
+	p = append(p, 53, 1, 7)                          // message type: release
+	p = append(p, 54, 4)                             // server identifier
+	p = append(p, server.To4()...)
+	return append(p, 255)
+}
+
+// restore puts back the default routes and DNS settings as before the
+// lease, after the interface is closed with its own routes
+func (n *netConfig) restore() {
+	for i := range n.routes {
+		if err := netlink.RouteAdd(&n.routes[i]); err != nil {
+			// still there
+			Debug("route %v: %v\n", n.routes[i].Gw, err)
+		}
+	}
+	if n.resolv == nil {
+		return
+	}
+	if cur, err := ioutil.ReadFile(resolvConf); err == nil && bytes.Equal(cur, n.resolv) {
+		return
+	}
+	if err := ioutil.WriteFile(resolvConf, n.resolv, 0644); err != nil {
+		Debug("err: %v\n", err)
+	}
+}
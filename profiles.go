@@ -0,0 +1,383 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pelletier/go-toml"
+
+	"gosec/secret"
+	"gosec/softether"
+)
+
+// Connection profiles are kept in profiles.toml of the config directory, as
+// an array of tables, e.g.
+//
+//	[[profile]]
+//	name = "office"
+//	host = "vpn.example.com"
+//	port = 443
+//	hub = "SALES"
+//	user = "me"
+//	auth = "password"
+//	pins = ["D6:C4:7E:..."]
+//	conns = 4
+//	compress = true
+//	keepalive = "10s"
+//
+// Passwords and passphrases are kept in the secret store instead, by the
+// profile name.
+
+// profile is a named set of connection settings of vpnSetting
+type profile struct {
+	Name string `toml:"name"`
+	Host string `toml:"host"`
+	// 443 if 0
+	Port int    `toml:"port"`
+	Hub  string `toml:"hub"`
+	User string `toml:"user"`
+	// password, plain, cert or anonymous
+	Auth string `toml:"auth"`
+	// base64 of the password hash of a .vpn file imported, kept here before
+	// the secret store, moved there when saved
+	Hashed   string   `toml:"hashed,omitempty"`
+	CertFile string   `toml:"cert,omitempty"`
+	KeyFile  string   `toml:"key,omitempty"`
+	CAFile   string   `toml:"ca,omitempty"`
+	Pins     []string `toml:"pins,omitempty"`
+
+	Conns    int  `toml:"conns"`
+	Half     bool `toml:"half"`
+	Compress bool `toml:"compress"`
+	UDP      bool `toml:"udp"`
+	// durations as "10s" or "1m30s", see durations
+	KeepAlive string `toml:"keepalive,omitempty"`
+	Timeout   string `toml:"timeout,omitempty"`
+}
+
+// durations returns KeepAlive and Timeout of p, 0 if not set
+func (p profile) durations() (keepAlive, timeout time.Duration, err error) {
+	if p.KeepAlive != "" {
+		if keepAlive, err = time.ParseDuration(p.KeepAlive); err != nil {
+			return 0, 0, fmt.Errorf("keepalive: %v", err)
+		}
+	}
+	if p.Timeout != "" {
+		if timeout, err = time.ParseDuration(p.Timeout); err != nil {
+			return 0, 0, fmt.Errorf("timeout: %v", err)
+		}
+	}
+	return keepAlive, timeout, nil
+}
+
+type profileFile struct {
+	Profiles []profile `toml:"profile"`
+}
+
+// profileAuths are the values of auth in a profile, by auth type
+var profileAuths = map[int]string{
+	softether.AuthPassword:      "password",
+	softether.AuthPlainPassword: "plain",
+	softether.AuthCert:          "cert",
+}
+
+func profilesPath() string {
+	return configPath("profiles.toml")
+}
+
+// loadProfiles returns the profiles saved, none if no file yet
+func loadProfiles() ([]profile, error) {
+	data, err := ioutil.ReadFile(profilesPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var f profileFile
+	if err := toml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %v", profilesPath(), err)
+	}
+	for _, p := range f.Profiles {
+		keepAlive, timeout, err := p.durations()
+		if err == nil {
+			err = checkKeepAlive(keepAlive, timeout)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: profile %s: %v", profilesPath(), p.Name, err)
+		}
+	}
+	return f.Profiles, nil
+}
+
+// findProfile returns the profile of name
+func findProfile(name string) (profile, error) {
+	profiles, err := loadProfiles()
+	if err != nil {
+		return profile{}, err
+	}
+	for _, p := range profiles {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return profile{}, fmt.Errorf("no profile %q in %s", name, profilesPath())
+}
+
+// saveProfile saves p, replacing the profile of the same name
+func saveProfile(p profile) error {
+	path := profilesPath()
+	if path == "" {
+		return errors.New("no home directory for profiles")
+	}
+	profiles, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+	replaced := false
+	for i := range profiles {
+		if profiles[i].Name == p.Name {
+			profiles[i] = p
+			replaced = true
+		}
+	}
+	if !replaced {
+		profiles = append(profiles, p)
+	}
+	data, err := toml.Marshal(profileFile{profiles})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// toProfile returns the settings of c as profile name
+func (c *vpnSetting) toProfile(name string) profile {
+	p := profile{
+		Name:     name,
+		Host:     c.host,
+		Hub:      c.hub,
+		User:     c.usr,
+		Auth:     profileAuths[c.authType],
+		CAFile:   c.caFile,
+		Pins:     c.pins,
+		Conns:    c.maxConn,
+		Half:     c.halfConn,
+		Compress: c.compress,
+		UDP:      c.udpAccel,
+	}
+	if c.keepAlive != 0 {
+		p.KeepAlive = c.keepAlive.String()
+	}
+	if c.keepAliveTimeout != 0 {
+		p.Timeout = c.keepAliveTimeout.String()
+	}
+	if host, port, err := net.SplitHostPort(softether.HostPort(c.host)); err == nil {
+		p.Host = host
+		p.Port, _ = strconv.Atoi(port)
+	}
+	if c.anonymous {
+		p.Auth = "anonymous"
+	}
+	if c.authType == softether.AuthCert {
+		p.CertFile = c.certFile
+		p.KeyFile = c.keyFile
+	}
+	return p
+}
+
+// fromProfile sets the settings of c by p, the secrets of p are taken by
+// loadSecrets
+func (c *vpnSetting) fromProfile(p profile) {
+	c.profile = p.Name
+	c.host = p.Host
+	if p.Port != 0 && p.Port != 443 {
+		c.host = net.JoinHostPort(p.Host, strconv.Itoa(p.Port))
+	}
+	c.hub = p.Hub
+	c.usr = p.User
+	c.anonymous = p.Auth == "anonymous"
+	c.authType = softether.AuthPassword
+	for authType, name := range profileAuths {
+		if p.Auth == name {
+			c.authType = authType
+		}
+	}
+	c.passwd = ""
+	c.passwdKept = false
+	c.hashedPasswd, _ = base64.StdEncoding.DecodeString(p.Hashed)
+	if len(c.hashedPasswd) == 0 {
+		c.hashedPasswd = nil
+	}
+	c.certFile = p.CertFile
+	c.keyFile = p.KeyFile
+	c.caFile = p.CAFile
+	c.pins = p.Pins
+	c.maxConn = p.Conns
+	c.halfConn = p.Half
+	c.compress = p.Compress
+	c.udpAccel = p.UDP
+	// checked by loadProfiles
+	c.keepAlive, c.keepAliveTimeout, _ = p.durations()
+	if c.keepAlive == 0 {
+		c.keepAlive = softether.DefaultKeepAlive
+	}
+	c.limitConns()
+}
+
+// saveAsProfile saves the settings of c as profile name, with the secrets
+func (c *vpnSetting) saveAsProfile(name string) error {
+	if err := saveProfile(c.toProfile(name)); err != nil {
+		return err
+	}
+	return c.saveSecrets(name)
+}
+
+var (
+	secretsOnce sync.Once
+	secretStore secret.Store
+)
+
+// secrets is the store of the secrets of profiles
+func secrets() secret.Store {
+	secretsOnce.Do(func() {
+		secretStore = secret.Open("gosec", configPath("secrets"))
+		Debug("secrets kept in %v\n", secretStore)
+	})
+	return secretStore
+}
+
+// secretKind is what passwd is, by authType
+func (c *vpnSetting) secretKind() string {
+	if c.authType == softether.AuthCert {
+		return "passphrase"
+	}
+	return "password"
+}
+
+// saveSecrets keeps the password or passphrase of c, and the hash of one
+// imported, as the secrets of profile name, or forgets them if empty. The
+// secrets of the other auth types are forgotten, a password only wiped from
+// the form, or not loaded yet, is left as saved.
+func (c *vpnSetting) saveSecrets(name string) error {
+	for _, kind := range []string{"password", "passphrase", "hash"} {
+		var s string
+		switch {
+		case kind == c.secretKind():
+			if c.passwd == "" && c.passwdKept {
+				continue
+			}
+			s = c.passwd
+		case kind == "hash" && c.authType == softether.AuthPassword:
+			if c.hashedPasswd == nil && c.passwdKept {
+				continue
+			}
+			if c.hashedPasswd != nil {
+				s = base64.StdEncoding.EncodeToString(c.hashedPasswd)
+			}
+		}
+		key := name + "/" + kind
+		var err error
+		if s != "" {
+			err = secrets().Set(key, "gosec "+name+" "+kind, s)
+		} else if err = secrets().Delete(key); err == secret.ErrNotFound {
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s of %s in %v: %v", kind, name, secrets(), err)
+		}
+	}
+	return nil
+}
+
+// loadSecrets takes the password or passphrase of profile name, and the
+// hash of one imported, from the secret store
+func (c *vpnSetting) loadSecrets(name string) {
+	passwd, hashed := getSecrets(name, c.secretKind())
+	if passwd != "" {
+		c.passwd = passwd
+	}
+	if hashed != nil {
+		c.hashedPasswd = hashed
+	}
+}
+
+// loadedSecrets are the secrets of kind of profile name taken by
+// loadSecretsLater
+type loadedSecrets struct {
+	name, kind string
+	passwd     string
+	hashed     []byte
+}
+
+// loadSecretsLater is loadSecrets for the UI, which it mustn't block while
+// the secret store prompts to unlock. The secrets are taken in the
+// background and applied by applySecrets, and until then a Save leaves them
+// as saved.
+func (c *vpnSetting) loadSecretsLater(name string) {
+	if c.loaded == nil {
+		c.loaded = make(chan loadedSecrets, 4)
+	}
+	kind := c.secretKind()
+	c.passwdKept = true
+	go func() {
+		passwd, hashed := getSecrets(name, kind)
+		c.loaded <- loadedSecrets{name: name, kind: kind, passwd: passwd, hashed: hashed}
+		c.changed()
+	}()
+}
+
+// applySecrets takes the secrets loaded by loadSecretsLater, on the goroutine
+// of the UI, unless another profile was picked or the password edited
+// meanwhile
+func (c *vpnSetting) applySecrets() {
+	for {
+		var l loadedSecrets
+		select {
+		case l = <-c.loaded:
+		default:
+			return
+		}
+		if c.profile != l.name || c.secretKind() != l.kind {
+			continue
+		}
+		if l.passwd != "" && c.passwd == "" && c.passwdKept {
+			c.passwd = l.passwd
+		}
+		if l.hashed != nil {
+			c.hashedPasswd = l.hashed
+		}
+	}
+}
+
+// getSecrets returns the secret of kind of profile name and the hash of one
+// imported, empty if none
+func getSecrets(name, kind string) (passwd string, hashed []byte) {
+	passwd, err := secrets().Get(name + "/" + kind)
+	if err != nil && err != secret.ErrNotFound {
+		Debug("err: %s of %s: %v\n", kind, name, err)
+	}
+	hash, err := secrets().Get(name + "/hash")
+	if err == nil {
+		if hashed, err = base64.StdEncoding.DecodeString(hash); err != nil {
+			hashed = nil
+		}
+	} else if err != secret.ErrNotFound {
+		Debug("err: hash of %s: %v\n", name, err)
+	}
+	return passwd, hashed
+}
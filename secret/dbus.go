@@ -0,0 +1,728 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package secret
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Just enough of D-Bus to call methods of the Secret Service on the session
+// bus and wait for the signal of a prompt, see
+// https://dbus.freedesktop.org/doc/dbus-specification.html
+//
+// Values are encoded by signature from these Go types:
+//	y byte, b bool, u uint32, s string, o objectPath, g signature,
+//	v variant, ay []byte, as/ao []string or []objectPath,
+//	a{ss} map[string]string, a{sv} map[string]variant, (...) []interface{}
+// and decoded to the same, but arrays other than ay to []interface{}, dicts
+// to map[string]interface{}, and variants to their value.
+
+type objectPath string
+
+type variant struct {
+	sig   string
+	value interface{}
+}
+
+const (
+	msgCall   = 1
+	msgReturn = 2
+	msgError  = 3
+	msgSignal = 4
+)
+
+// header fields
+const (
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSignature   = 8
+)
+
+// callTimeout is the default timeout of D-Bus method calls
+const callTimeout = 25 * time.Second
+
+// busError is an error reply
+type busError struct {
+	name, msg string
+}
+
+func (e busError) Error() string { return e.name + ": " + e.msg }
+
+type message struct {
+	typ         byte
+	serial      uint32
+	path        objectPath
+	iface       string
+	member      string
+	errName     string
+	replySerial uint32
+	sig         string
+	order       binary.ByteOrder
+	body        []byte
+}
+
+// args decodes the body by its signature
+func (m *message) args() ([]interface{}, error) {
+	d := decoder{order: m.order, b: m.body}
+	return d.values(m.sig)
+}
+
+// nextType splits the first complete type off sig
+func nextType(sig string) (string, string, error) {
+	if sig == "" {
+		return "", "", errors.New("empty signature")
+	}
+	switch sig[0] {
+	case 'a':
+		elem, rest, err := nextType(sig[1:])
+		return "a" + elem, rest, err
+	case '(', '{':
+		depth := 0
+		for i := 0; i < len(sig); i++ {
+			switch sig[i] {
+			case '(', '{':
+				depth++
+			case ')', '}':
+				depth--
+				if depth == 0 {
+					return sig[:i+1], sig[i+1:], nil
+				}
+			}
+		}
+		return "", "", fmt.Errorf("unbalanced signature %q", sig)
+	}
+	return sig[:1], sig[1:], nil
+}
+
+// alignOf is the alignment of values of type sig
+func alignOf(sig string) int {
+	switch sig[0] {
+	case 'y', 'g', 'v':
+		return 1
+	case 'n', 'q':
+		return 2
+	case 'x', 't', 'd', '(', '{':
+		return 8
+	}
+	return 4
+}
+
+type encoder struct {
+	order binary.ByteOrder
+	b     []byte
+}
+
+func (e *encoder) align(n int) {
+	for len(e.b)%n != 0 {
+		e.b = append(e.b, 0)
+	}
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.align(4)
+	var b [4]byte
+	e.order.PutUint32(b[:], v)
+	e.b = append(e.b, b[:]...)
+}
+
+func (e *encoder) str(s string) {
+	e.uint32(uint32(len(s)))
+	e.b = append(e.b, s...)
+	e.b = append(e.b, 0)
+}
+
+func (e *encoder) signature(s string) {
+	e.b = append(e.b, byte(len(s)))
+	e.b = append(e.b, s...)
+	e.b = append(e.b, 0)
+}
+
+// values encodes vs by sig of as many complete types
+func (e *encoder) values(sig string, vs ...interface{}) error {
+	for _, v := range vs {
+		typ, rest, err := nextType(sig)
+		if err != nil {
+			return err
+		}
+		if err := e.value(typ, v); err != nil {
+			return err
+		}
+		sig = rest
+	}
+	if sig != "" {
+		return fmt.Errorf("no value for %q", sig)
+	}
+	return nil
+}
+
+func (e *encoder) value(sig string, v interface{}) error {
+	bad := fmt.Errorf("%T is not of D-Bus type %q", v, sig)
+	switch sig[0] {
+	case 'y':
+		b, ok := v.(byte)
+		if !ok {
+			return bad
+		}
+		e.b = append(e.b, b)
+	case 'b':
+		b, ok := v.(bool)
+		if !ok {
+			return bad
+		}
+		if b {
+			e.uint32(1)
+		} else {
+			e.uint32(0)
+		}
+	case 'u':
+		u, ok := v.(uint32)
+		if !ok {
+			return bad
+		}
+		e.uint32(u)
+	case 's', 'o':
+		switch s := v.(type) {
+		case string:
+			e.str(s)
+		case objectPath:
+			e.str(string(s))
+		default:
+			return bad
+		}
+	case 'g':
+		s, ok := v.(string)
+		if !ok {
+			return bad
+		}
+		e.signature(s)
+	case 'v':
+		vv, ok := v.(variant)
+		if !ok {
+			return bad
+		}
+		e.signature(vv.sig)
+		return e.value(vv.sig, vv.value)
+	case '(':
+		fields, ok := v.([]interface{})
+		if !ok {
+			return bad
+		}
+		e.align(8)
+		return e.values(sig[1:len(sig)-1], fields...)
+	case 'a':
+		return e.array(sig, v)
+	default:
+		return bad
+	}
+	return nil
+}
+
+func (e *encoder) array(sig string, v interface{}) error {
+	elem := sig[1:]
+	e.uint32(0)
+	lenAt := len(e.b) - 4
+	e.align(alignOf(elem))
+	start := len(e.b)
+	var err error
+	switch a := v.(type) {
+	case []byte:
+		if elem != "y" {
+			return fmt.Errorf("[]byte is not of D-Bus type %q", sig)
+		}
+		e.b = append(e.b, a...)
+	case []string:
+		for _, s := range a {
+			if err = e.value(elem, s); err != nil {
+				break
+			}
+		}
+	case []objectPath:
+		for _, s := range a {
+			if err = e.value(elem, s); err != nil {
+				break
+			}
+		}
+	case []interface{}:
+		for _, x := range a {
+			if err = e.value(elem, x); err != nil {
+				break
+			}
+		}
+	case map[string]string:
+		keys := make([]string, 0, len(a))
+		for k := range a {
+			keys = append(keys, k)
+		}
+		err = e.dict(elem, keys, func(k string) interface{} { return a[k] })
+	case map[string]variant:
+		keys := make([]string, 0, len(a))
+		for k := range a {
+			keys = append(keys, k)
+		}
+		err = e.dict(elem, keys, func(k string) interface{} { return a[k] })
+	default:
+		return fmt.Errorf("%T is not of D-Bus type %q", v, sig)
+	}
+	if err != nil {
+		return err
+	}
+	e.order.PutUint32(e.b[lenAt:], uint32(len(e.b)-start))
+	return nil
+}
+
+// dict encodes the entries {k v} of keys, sorted
+func (e *encoder) dict(elem string, keys []string, value func(string) interface{}) error {
+	if elem[0] != '{' {
+		return fmt.Errorf("map is not of D-Bus type a%s", elem)
+	}
+	kt, vt, err := nextType(elem[1 : len(elem)-1])
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		e.align(8)
+		if err := e.value(kt, k); err != nil {
+			return err
+		}
+		if err := e.value(vt, value(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type decoder struct {
+	order binary.ByteOrder
+	b     []byte
+	off   int
+}
+
+var errShort = errors.New("D-Bus message too short")
+
+func (d *decoder) align(n int) error {
+	for d.off%n != 0 {
+		d.off++
+	}
+	if d.off > len(d.b) {
+		return errShort
+	}
+	return nil
+}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if d.off+n > len(d.b) || n < 0 {
+		return nil, errShort
+	}
+	b := d.b[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	if err := d.align(4); err != nil {
+		return 0, err
+	}
+	b, err := d.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint32(b), nil
+}
+
+func (d *decoder) values(sig string) ([]interface{}, error) {
+	var vs []interface{}
+	for sig != "" {
+		typ, rest, err := nextType(sig)
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.value(typ)
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+		sig = rest
+	}
+	return vs, nil
+}
+
+func (d *decoder) value(sig string) (interface{}, error) {
+	if err := d.align(alignOf(sig)); err != nil {
+		return nil, err
+	}
+	switch sig[0] {
+	case 'y':
+		b, err := d.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0], nil
+	case 'n', 'q':
+		b, err := d.next(2)
+		if err != nil {
+			return nil, err
+		}
+		return d.order.Uint16(b), nil
+	case 'b', 'u', 'i', 'h':
+		return d.uint32Value(sig[0])
+	case 'x', 't', 'd':
+		b, err := d.next(8)
+		if err != nil {
+			return nil, err
+		}
+		u := d.order.Uint64(b)
+		if sig[0] == 'd' {
+			return math.Float64frombits(u), nil
+		}
+		return u, nil
+	case 's', 'o':
+		n, err := d.uint32()
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.next(int(n) + 1)
+		if err != nil {
+			return nil, err
+		}
+		if sig[0] == 'o' {
+			return objectPath(b[:n]), nil
+		}
+		return string(b[:n]), nil
+	case 'g':
+		return d.signature()
+	case 'v':
+		vsig, err := d.signature()
+		if err != nil {
+			return nil, err
+		}
+		typ, rest, err := nextType(vsig)
+		if err != nil || rest != "" {
+			return nil, fmt.Errorf("bad variant signature %q", vsig)
+		}
+		return d.value(typ)
+	case '(':
+		return d.values(sig[1 : len(sig)-1])
+	case 'a':
+		return d.array(sig[1:])
+	}
+	return nil, fmt.Errorf("D-Bus type %q not supported", sig)
+}
+
+func (d *decoder) uint32Value(typ byte) (interface{}, error) {
+	u, err := d.uint32()
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case 'b':
+		return u != 0, nil
+	case 'i':
+		return int32(u), nil
+	}
+	return u, nil
+}
+
+func (d *decoder) signature() (string, error) {
+	n, err := d.next(1)
+	if err != nil {
+		return "", err
+	}
+	b, err := d.next(int(n[0]) + 1)
+	if err != nil {
+		return "", err
+	}
+	return string(b[:n[0]]), nil
+}
+
+func (d *decoder) array(elem string) (interface{}, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if err := d.align(alignOf(elem)); err != nil {
+		return nil, err
+	}
+	end := d.off + int(n)
+	if end > len(d.b) {
+		return nil, errShort
+	}
+	if elem == "y" {
+		b, _ := d.next(int(n))
+		return append([]byte{}, b...), nil
+	}
+	if elem[0] == '{' {
+		kt, vt, err := nextType(elem[1 : len(elem)-1])
+		if err != nil {
+			return nil, err
+		}
+		m := map[string]interface{}{}
+		for d.off < end {
+			if err := d.align(8); err != nil {
+				return nil, err
+			}
+			k, err := d.value(kt)
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.value(vt)
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(k)] = v
+		}
+		return m, nil
+	}
+	var a []interface{}
+	for d.off < end {
+		v, err := d.value(elem)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+	}
+	return a, nil
+}
+
+// conn is a connection to a bus
+type conn struct {
+	c      net.Conn
+	r      *bufio.Reader
+	serial uint32
+	// signals received while waiting for replies
+	signals []*message
+}
+
+// sessionBus returns the address of the session bus, of the uid of the
+// process unless DBUS_SESSION_BUS_ADDRESS is set
+func sessionBus() string {
+	if addr := os.Getenv("DBUS_SESSION_BUS_ADDRESS"); addr != "" {
+		return addr
+	}
+	return "unix:path=/run/user/" + strconv.Itoa(os.Getuid()) + "/bus"
+}
+
+// dialBus connects to the first unix socket of addr and authenticates as
+// the uid of the process
+func dialBus(addr string) (*conn, error) {
+	var c net.Conn
+	err := errors.New("no unix socket in bus address " + addr)
+	for _, a := range strings.Split(addr, ";") {
+		if !strings.HasPrefix(a, "unix:") {
+			continue
+		}
+		for _, kv := range strings.Split(a[len("unix:"):], ",") {
+			var path string
+			if strings.HasPrefix(kv, "path=") {
+				path = kv[len("path="):]
+			} else if strings.HasPrefix(kv, "abstract=") {
+				path = "@" + kv[len("abstract="):]
+			} else {
+				continue
+			}
+			if path, err = url.PathUnescape(path); err != nil {
+				continue
+			}
+			if c, err = net.DialTimeout("unix", path, callTimeout); err == nil {
+				break
+			}
+		}
+		if c != nil {
+			break
+		}
+	}
+	if c == nil {
+		return nil, err
+	}
+
+	bc := &conn{c: c, r: bufio.NewReader(c)}
+	c.SetDeadline(time.Now().Add(callTimeout))
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := io.WriteString(c, "\x00AUTH EXTERNAL "+uid+"\r\n"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	line, err := bc.r.ReadString('\n')
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		c.Close()
+		return nil, fmt.Errorf("D-Bus authentication: %s", strings.TrimSpace(line))
+	}
+	if _, err := io.WriteString(c, "BEGIN\r\n"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if _, err := bc.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "Hello", ""); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return bc, nil
+}
+
+func (c *conn) Close() error {
+	return c.c.Close()
+}
+
+func (c *conn) write(m *message, fields []interface{}, body []byte) error {
+	e := encoder{order: binary.LittleEndian, b: []byte{'l', m.typ, 0, 1}}
+	e.uint32(uint32(len(body)))
+	e.uint32(m.serial)
+	if err := e.value("a(yv)", fields); err != nil {
+		return err
+	}
+	e.align(8)
+	_, err := c.c.Write(append(e.b, body...))
+	return err
+}
+
+func (c *conn) read() (*message, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, fixed); err != nil {
+		return nil, err
+	}
+	m := &message{typ: fixed[1]}
+	switch fixed[0] {
+	case 'l':
+		m.order = binary.LittleEndian
+	case 'B':
+		m.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("bad D-Bus byte order %q", fixed[0])
+	}
+	bodyLen := m.order.Uint32(fixed[4:])
+	m.serial = m.order.Uint32(fixed[8:])
+	fieldsLen := m.order.Uint32(fixed[12:])
+	headerLen := 16 + int(fieldsLen)
+	headerLen += (8 - headerLen%8) % 8
+	if fieldsLen > 1<<26 || bodyLen > 1<<27 {
+		return nil, errors.New("D-Bus message too long")
+	}
+	rest := make([]byte, headerLen-16+int(bodyLen))
+	if _, err := io.ReadFull(c.r, rest); err != nil {
+		return nil, err
+	}
+	header := append(fixed, rest[:headerLen-16]...)
+	m.body = rest[headerLen-16:]
+
+	d := decoder{order: m.order, b: header, off: 12}
+	v, err := d.value("a(yv)")
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range v.([]interface{}) {
+		f := f.([]interface{})
+		switch f[0].(byte) {
+		case fieldPath:
+			m.path, _ = f[1].(objectPath)
+		case fieldInterface:
+			m.iface, _ = f[1].(string)
+		case fieldMember:
+			m.member, _ = f[1].(string)
+		case fieldErrorName:
+			m.errName, _ = f[1].(string)
+		case fieldReplySerial:
+			m.replySerial, _ = f[1].(uint32)
+		case fieldSignature:
+			m.sig, _ = f[1].(string)
+		}
+	}
+	return m, nil
+}
+
+// call calls method member and returns the reply, sig is of args
+func (c *conn) call(dest string, path objectPath, iface, member, sig string, args ...interface{}) ([]interface{}, error) {
+	m := &message{typ: msgCall, path: path, iface: iface, member: member, sig: sig}
+	c.c.SetDeadline(time.Now().Add(callTimeout))
+	if err := c.sendTo(m, dest, args...); err != nil {
+		return nil, err
+	}
+	for {
+		r, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case r.typ == msgSignal:
+			c.signals = append(c.signals, r)
+		case r.replySerial != m.serial:
+		case r.typ == msgError:
+			e := busError{name: r.errName}
+			if args, err := r.args(); err == nil && len(args) > 0 {
+				e.msg, _ = args[0].(string)
+			}
+			return nil, e
+		case r.typ == msgReturn:
+			return r.args()
+		}
+	}
+}
+
+// sendTo sends m to dest
+func (c *conn) sendTo(m *message, dest string, args ...interface{}) error {
+	body := encoder{order: binary.LittleEndian}
+	if err := body.values(m.sig, args...); err != nil {
+		return err
+	}
+	c.serial++
+	m.serial = c.serial
+	fields := []interface{}{
+		[]interface{}{byte(fieldPath), variant{"o", m.path}},
+		[]interface{}{byte(fieldInterface), variant{"s", m.iface}},
+		[]interface{}{byte(fieldMember), variant{"s", m.member}},
+		[]interface{}{byte(fieldDestination), variant{"s", dest}},
+	}
+	if m.sig != "" {
+		fields = append(fields, []interface{}{byte(fieldSignature), variant{"g", m.sig}})
+	}
+	return c.write(m, fields, body.b)
+}
+
+// waitSignal waits up to timeout for signal member of iface from path, and
+// returns its args
+func (c *conn) waitSignal(path objectPath, iface, member string, timeout time.Duration) ([]interface{}, error) {
+	c.c.SetDeadline(time.Now().Add(timeout))
+	for {
+		var m *message
+		if len(c.signals) > 0 {
+			m, c.signals = c.signals[0], c.signals[1:]
+		} else {
+			var err error
+			if m, err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		if m.typ == msgSignal && m.path == path && m.iface == iface && m.member == member {
+			return m.args()
+		}
+	}
+}
+
+// arg is args[i], nil if not as many
+func arg(args []interface{}, i int) interface{} {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// file keeps secrets encrypted by AES-GCM in a JSON file, by a key derived
+// from the machine id, the uid and a random salt of the file. It keeps
+// secrets out of plain sight and useless on another machine, but not from
+// the user or root of the machine, as there is nothing to unlock it with.
+type file struct {
+	app  string
+	path string
+}
+
+type fileContent struct {
+	Salt []byte
+	// sealed secrets by key, with the nonce ahead
+	Secrets map[string][]byte
+}
+
+var machineIDFiles = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+func (f *file) String() string { return "encrypted file " + f.path }
+
+func (f *file) load() (*fileContent, error) {
+	var fc fileContent
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		fc.Salt = make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, fc.Salt); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(data, &fc); err != nil {
+		return nil, errors.New(f.path + ": " + err.Error())
+	}
+	if fc.Secrets == nil {
+		fc.Secrets = map[string][]byte{}
+	}
+	return &fc, nil
+}
+
+func (f *file) save(fc *fileContent) error {
+	data, err := json.MarshalIndent(fc, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// aead is the cipher of fc, bound to key as additional data
+func (f *file) aead(fc *fileContent) (cipher.AEAD, error) {
+	var id []byte
+	for _, name := range machineIDFiles {
+		if data, err := ioutil.ReadFile(name); err == nil {
+			id = []byte(strings.TrimSpace(string(data)))
+			break
+		}
+	}
+	if len(id) == 0 {
+		return nil, errors.New("no machine id")
+	}
+	mac := hmac.New(sha256.New, fc.Salt)
+	mac.Write([]byte(f.app + "\x00" + strconv.Itoa(os.Getuid()) + "\x00"))
+	mac.Write(id)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (f *file) Get(key string) (string, error) {
+	fc, err := f.load()
+	if err != nil {
+		return "", err
+	}
+	sealed, ok := fc.Secrets[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	aead, err := f.aead(fc)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("bad secret of " + key)
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(key))
+	if err != nil {
+		return "", errors.New("secret of " + key + " not decrypted, from another machine?")
+	}
+	return string(plain), nil
+}
+
+func (f *file) Set(key, label, secret string) error {
+	fc, err := f.load()
+	if err != nil {
+		return err
+	}
+	aead, err := f.aead(fc)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	fc.Secrets[key] = aead.Seal(nonce, nonce, []byte(secret), []byte(key))
+	return f.save(fc)
+}
+
+func (f *file) Delete(key string) error {
+	fc, err := f.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := fc.Secrets[key]; !ok {
+		return ErrNotFound
+	}
+	delete(fc.Secrets, key)
+	return f.save(fc)
+}
@@ -0,0 +1,120 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package secret
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// The Linux kernel keyring, see keyctl(2). Keys of type "user" are kept in
+// the persistent keyring of the user, which outlives the login session for
+// a few days since last used, or else the user keyring, until the last
+// process of the user exits. Neither survives a reboot.
+
+const (
+	keySpecUserKeyring  = -4
+	keyctlGetKeyringID  = 0
+	keyctlUnlink        = 9
+	keyctlSearch        = 10
+	keyctlRead          = 11
+	keyctlGetPersistent = 22
+)
+
+type keyring struct {
+	app string
+	id  int
+}
+
+func keyctl(cmd int, args ...int) (int, error) {
+	var a [4]uintptr
+	for i, v := range args {
+		a[i] = uintptr(v)
+	}
+	r, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, uintptr(cmd), a[0], a[1], a[2], a[3], 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+func openKeyring(app string) (*keyring, error) {
+	// -1 for the uid of the process
+	id, err := keyctl(keyctlGetPersistent, -1, keySpecUserKeyring)
+	if err != nil {
+		if id, err = keyctl(keyctlGetKeyringID, keySpecUserKeyring, 1); err != nil {
+			return nil, err
+		}
+	}
+	return &keyring{app: app, id: id}, nil
+}
+
+func (k *keyring) String() string { return "kernel keyring" }
+
+// search returns the key of key
+func (k *keyring) search(key string) (int, error) {
+	typ, _ := syscall.BytePtrFromString("user")
+	desc, err := syscall.BytePtrFromString(k.app + ":" + key)
+	if err != nil {
+		return 0, err
+	}
+	r, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, keyctlSearch, uintptr(k.id),
+		uintptr(unsafe.Pointer(typ)), uintptr(unsafe.Pointer(desc)), 0, 0)
+	if errno == syscall.ENOKEY || errno == syscall.EKEYREVOKED || errno == syscall.EKEYEXPIRED {
+		return 0, ErrNotFound
+	} else if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+func (k *keyring) Get(key string) (string, error) {
+	id, err := k.search(key)
+	if err != nil {
+		return "", err
+	}
+	// the length first, then the payload
+	buf := make([]byte, 0, 64)
+	for {
+		r, _, errno := syscall.Syscall6(syscall.SYS_KEYCTL, keyctlRead, uintptr(id),
+			uintptr(unsafe.Pointer(&buf[:1][0])), uintptr(cap(buf)), 0, 0)
+		if errno != 0 {
+			return "", errno
+		}
+		if int(r) <= cap(buf) {
+			return string(buf[:r]), nil
+		}
+		buf = make([]byte, 0, r)
+	}
+}
+
+func (k *keyring) Set(key, label, secret string) error {
+	typ, _ := syscall.BytePtrFromString("user")
+	desc, err := syscall.BytePtrFromString(k.app + ":" + key)
+	if err != nil {
+		return err
+	}
+	payload := []byte(secret)
+	var p unsafe.Pointer
+	if len(payload) > 0 {
+		p = unsafe.Pointer(&payload[0])
+	}
+	// replaces the payload of the key of the same description
+	_, _, errno := syscall.Syscall6(syscall.SYS_ADD_KEY, uintptr(unsafe.Pointer(typ)),
+		uintptr(unsafe.Pointer(desc)), uintptr(p), uintptr(len(payload)), uintptr(k.id), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (k *keyring) Delete(key string) error {
+	id, err := k.search(key)
+	if err != nil {
+		return err
+	}
+	_, err = keyctl(keyctlUnlink, id, k.id)
+	return err
+}
@@ -0,0 +1,46 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package secret keeps secrets, like passwords, out of config files: in the
+// Secret Service of the desktop if there is one, else in the kernel keyring,
+// else in a file encrypted for the machine.
+//
+// Secrets are of the uid of the process in all three, which is root under
+// sudo, the same as the files of $HOME: the session bus of the uid, as a
+// session bus lets in no other user, its persistent keyring, and the key of
+// the file.
+package secret
+
+import (
+	"errors"
+)
+
+// ErrNotFound is returned for a key without secret
+var ErrNotFound = errors.New("no secret")
+
+// Store keeps secrets of an application by key
+type Store interface {
+	// Get returns the secret of key, ErrNotFound if none
+	Get(key string) (string, error)
+	// Set keeps secret as key, label is how the user sees it in a keyring
+	// manager like Seahorse
+	Set(key, label, secret string) error
+	// Delete forgets the secret of key, ErrNotFound if none
+	Delete(key string) error
+	// String tells where secrets are kept
+	String() string
+}
+
+// Open returns the first store available for app: the Secret Service on
+// the session bus, the kernel keyring, or else path, a file encrypted for
+// the machine.
+func Open(app, path string) Store {
+	if s, err := openService(app); err == nil {
+		return s
+	}
+	if k, err := openKeyring(app); err == nil {
+		return k
+	}
+	return &file{app: app, path: path}
+}
@@ -0,0 +1,186 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package secret
+
+import (
+	"errors"
+	"time"
+)
+
+// The freedesktop Secret Service, of GNOME Keyring, KeePassXC and others,
+// see https://specifications.freedesktop.org/secret-service/
+
+const (
+	ssName       = "org.freedesktop.secrets"
+	ssPath       = "/org/freedesktop/secrets"
+	ssService    = "org.freedesktop.Secret.Service"
+	ssCollection = "org.freedesktop.Secret.Collection"
+	ssItem       = "org.freedesktop.Secret.Item"
+	ssPrompt     = "org.freedesktop.Secret.Prompt"
+
+	ssDefault = objectPath("/org/freedesktop/secrets/aliases/default")
+	noPrompt  = objectPath("/")
+)
+
+// promptTimeout is how long the user may take to unlock the keyring
+const promptTimeout = 2 * time.Minute
+
+// service keeps secrets as items of the default collection, by attributes
+// of app and key
+type service struct {
+	app  string
+	addr string
+}
+
+// ssSession is a session of the Secret Service on a connection. Secrets are
+// transferred as is by the "plain" algorithm, only thru the local bus.
+type ssSession struct {
+	c    *conn
+	path objectPath
+}
+
+func openService(app string) (*service, error) {
+	s := &service{app: app, addr: sessionBus()}
+	ss, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	ss.c.Close()
+	return s, nil
+}
+
+func (s *service) String() string { return "Secret Service" }
+
+func (s *service) open() (*ssSession, error) {
+	c, err := dialBus(s.addr)
+	if err != nil {
+		return nil, err
+	}
+	out, err := c.call(ssName, ssPath, ssService, "OpenSession", "sv", "plain", variant{"s", ""})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	path, _ := arg(out, 1).(objectPath)
+	return &ssSession{c: c, path: path}, nil
+}
+
+func (s *service) attributes(key string) map[string]string {
+	return map[string]string{"application": s.app, "key": key}
+}
+
+// prompt shows prompt if any, for the user to unlock the keyring
+func (ss *ssSession) prompt(prompt objectPath) error {
+	if prompt == noPrompt || prompt == "" {
+		return nil
+	}
+	rule := "type='signal',interface='" + ssPrompt + "',member='Completed',path='" + string(prompt) + "'"
+	if _, err := ss.c.call("org.freedesktop.DBus", "/org/freedesktop/DBus", "org.freedesktop.DBus", "AddMatch", "s", rule); err != nil {
+		return err
+	}
+	if _, err := ss.c.call(ssName, prompt, ssPrompt, "Prompt", "s", ""); err != nil {
+		return err
+	}
+	out, err := ss.c.waitSignal(prompt, ssPrompt, "Completed", promptTimeout)
+	if err != nil {
+		return err
+	}
+	if dismissed, _ := arg(out, 0).(bool); dismissed {
+		return errors.New("keyring not unlocked")
+	}
+	return nil
+}
+
+// unlock unlocks the items or collections of paths
+func (ss *ssSession) unlock(paths []objectPath) error {
+	out, err := ss.c.call(ssName, ssPath, ssService, "Unlock", "ao", paths)
+	if err != nil {
+		return err
+	}
+	prompt, _ := arg(out, 1).(objectPath)
+	return ss.prompt(prompt)
+}
+
+// find returns the item of key, unlocked
+func (ss *ssSession) find(attrs map[string]string) (objectPath, error) {
+	out, err := ss.c.call(ssName, ssPath, ssService, "SearchItems", "a{ss}", attrs)
+	if err != nil {
+		return "", err
+	}
+	unlocked, _ := arg(out, 0).([]interface{})
+	locked, _ := arg(out, 1).([]interface{})
+	if len(unlocked) > 0 {
+		item, _ := unlocked[0].(objectPath)
+		return item, nil
+	}
+	if len(locked) == 0 {
+		return "", ErrNotFound
+	}
+	item, _ := locked[0].(objectPath)
+	return item, ss.unlock([]objectPath{item})
+}
+
+func (s *service) Get(key string) (string, error) {
+	ss, err := s.open()
+	if err != nil {
+		return "", err
+	}
+	defer ss.c.Close()
+	item, err := ss.find(s.attributes(key))
+	if err != nil {
+		return "", err
+	}
+	out, err := ss.c.call(ssName, item, ssItem, "GetSecret", "o", ss.path)
+	if err != nil {
+		return "", err
+	}
+	// (session, parameters, value, content type)
+	secret, _ := arg(out, 0).([]interface{})
+	if len(secret) != 4 {
+		return "", errors.New("bad secret of " + string(item))
+	}
+	value, _ := secret[2].([]byte)
+	return string(value), nil
+}
+
+func (s *service) Set(key, label, secret string) error {
+	ss, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer ss.c.Close()
+	if err := ss.unlock([]objectPath{ssDefault}); err != nil {
+		return err
+	}
+	props := map[string]variant{
+		ssItem + ".Label":      {"s", label},
+		ssItem + ".Attributes": {"a{ss}", s.attributes(key)},
+	}
+	value := []interface{}{ss.path, []byte{}, []byte(secret), "text/plain"}
+	out, err := ss.c.call(ssName, ssDefault, ssCollection, "CreateItem", "a{sv}(oayays)b", props, value, true)
+	if err != nil {
+		return err
+	}
+	prompt, _ := arg(out, 1).(objectPath)
+	return ss.prompt(prompt)
+}
+
+func (s *service) Delete(key string) error {
+	ss, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer ss.c.Close()
+	item, err := ss.find(s.attributes(key))
+	if err != nil {
+		return err
+	}
+	out, err := ss.c.call(ssName, item, ssItem, "Delete", "")
+	if err != nil {
+		return err
+	}
+	prompt, _ := arg(out, 0).(objectPath)
+	return ss.prompt(prompt)
+}
@@ -0,0 +1,316 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package secret
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeBus is a session bus in process with just a Secret Service on it,
+// whose items are locked with the collection. Unlocking them takes a
+// prompt, which the user completes unless dismiss is set.
+type fakeBus struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu      sync.Mutex
+	items   map[objectPath]*fakeItem
+	nItems  int
+	locked  bool
+	dismiss bool
+	prompts int
+}
+
+type fakeItem struct {
+	attrs  map[string]interface{}
+	secret []byte
+}
+
+// startFakeBus listens on a unix socket in a temporary directory, and sets
+// DBUS_SESSION_BUS_ADDRESS to it
+func startFakeBus(t *testing.T) *fakeBus {
+	path := filepath.Join(t.TempDir(), "bus")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", "unix:path="+path)
+	b := &fakeBus{ln: ln, items: map[objectPath]*fakeItem{}}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b.wg.Add(1)
+			go func() {
+				defer b.wg.Done()
+				defer c.Close()
+				b.serve(&conn{c: c, r: bufio.NewReader(c)})
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		b.wg.Wait()
+	})
+	return b
+}
+
+// lock locks the collection, whose prompt is dismissed if dismiss
+func (b *fakeBus) lock(dismiss bool) {
+	b.mu.Lock()
+	b.locked = true
+	b.dismiss = dismiss
+	b.mu.Unlock()
+}
+
+// promptsShown returns how many prompts were shown
+func (b *fakeBus) promptsShown() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.prompts
+}
+
+// serve authenticates c, then answers its calls until it is closed
+func (b *fakeBus) serve(c *conn) {
+	line, err := c.r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "\x00AUTH EXTERNAL ") {
+		return
+	}
+	fmt.Fprint(c.c, "OK 0123456789abcdef0123456789abcdef\r\n")
+	if line, err = c.r.ReadString('\n'); err != nil || line != "BEGIN\r\n" {
+		return
+	}
+	for {
+		m, err := c.read()
+		if err != nil {
+			return
+		}
+		if m.typ != msgCall {
+			continue
+		}
+		args, err := m.args()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		sig, out, errName := b.call(m, args)
+		dismissed := b.dismiss
+		b.mu.Unlock()
+		if errName != "" {
+			err = c.reply(m, msgError, "s", errName, m.member+" failed")
+		} else {
+			err = c.reply(m, msgReturn, sig, "", out...)
+		}
+		if err != nil {
+			return
+		}
+		if m.member == "Prompt" {
+			c.signal(m.path, ssPrompt, "Completed", "bv", dismissed, variant{"ao", []objectPath{}})
+		}
+	}
+}
+
+// call runs method m, and returns the signature and args of its reply or
+// the name of its error
+func (b *fakeBus) call(m *message, args []interface{}) (string, []interface{}, string) {
+	const prompt = objectPath("/org/freedesktop/secrets/prompt/p1")
+	switch m.member {
+	case "Hello":
+		return "s", []interface{}{":1.1"}, ""
+	case "AddMatch":
+		return "", nil, ""
+	case "OpenSession":
+		if arg(args, 0) != "plain" {
+			return "", nil, "org.freedesktop.DBus.Error.NotSupported"
+		}
+		return "vo", []interface{}{variant{"s", ""}, objectPath("/org/freedesktop/secrets/session/s1")}, ""
+	case "SearchItems":
+		attrs, _ := arg(args, 0).(map[string]interface{})
+		found := []objectPath{}
+		for path, item := range b.items {
+			if fmt.Sprint(item.attrs) == fmt.Sprint(attrs) {
+				found = append(found, path)
+			}
+		}
+		if b.locked {
+			return "aoao", []interface{}{[]objectPath{}, found}, ""
+		}
+		return "aoao", []interface{}{found, []objectPath{}}, ""
+	case "Unlock":
+		if b.locked {
+			return "aoo", []interface{}{[]objectPath{}, prompt}, ""
+		}
+		return "aoo", []interface{}{args[0], noPrompt}, ""
+	case "Prompt":
+		if m.path != prompt {
+			return "", nil, "org.freedesktop.DBus.Error.UnknownObject"
+		}
+		b.prompts++
+		if !b.dismiss {
+			b.locked = false
+		}
+		return "", nil, ""
+	}
+
+	if b.locked {
+		return "", nil, "org.freedesktop.Secret.Error.IsLocked"
+	}
+	switch m.member {
+	case "CreateItem":
+		props, _ := arg(args, 0).(map[string]interface{})
+		value, _ := arg(args, 1).([]interface{})
+		attrs, _ := props[ssItem+".Attributes"].(map[string]interface{})
+		if m.path != ssDefault || attrs == nil || len(value) != 4 {
+			return "", nil, "org.freedesktop.DBus.Error.InvalidArgs"
+		}
+		for path, item := range b.items {
+			if fmt.Sprint(item.attrs) == fmt.Sprint(attrs) && arg(args, 2) == true {
+				item.secret = value[2].([]byte)
+				return "oo", []interface{}{path, noPrompt}, ""
+			}
+		}
+		b.nItems++
+		path := objectPath(fmt.Sprintf("%s/%d", ssDefault, b.nItems))
+		b.items[path] = &fakeItem{attrs: attrs, secret: value[2].([]byte)}
+		return "oo", []interface{}{path, noPrompt}, ""
+	case "GetSecret":
+		item := b.items[m.path]
+		if item == nil {
+			return "", nil, "org.freedesktop.Secret.Error.NoSuchObject"
+		}
+		return "(oayays)", []interface{}{[]interface{}{arg(args, 0), []byte{}, item.secret, "text/plain"}}, ""
+	case "Delete":
+		if b.items[m.path] == nil {
+			return "", nil, "org.freedesktop.Secret.Error.NoSuchObject"
+		}
+		delete(b.items, m.path)
+		return "o", []interface{}{noPrompt}, ""
+	}
+	return "", nil, "org.freedesktop.DBus.Error.UnknownMethod"
+}
+
+// reply sends a reply of typ to call m, errName for an error
+func (c *conn) reply(m *message, typ byte, sig, errName string, args ...interface{}) error {
+	body := encoder{order: binary.LittleEndian}
+	if err := body.values(sig, args...); err != nil {
+		return err
+	}
+	c.serial++
+	fields := []interface{}{
+		[]interface{}{byte(fieldReplySerial), variant{"u", m.serial}},
+	}
+	if errName != "" {
+		fields = append(fields, []interface{}{byte(fieldErrorName), variant{"s", errName}})
+	}
+	if sig != "" {
+		fields = append(fields, []interface{}{byte(fieldSignature), variant{"g", sig}})
+	}
+	return c.write(&message{typ: typ, serial: c.serial}, fields, body.b)
+}
+
+// signal emits signal member of iface from path
+func (c *conn) signal(path objectPath, iface, member, sig string, args ...interface{}) error {
+	body := encoder{order: binary.LittleEndian}
+	if err := body.values(sig, args...); err != nil {
+		return err
+	}
+	c.serial++
+	fields := []interface{}{
+		[]interface{}{byte(fieldPath), variant{"o", path}},
+		[]interface{}{byte(fieldInterface), variant{"s", iface}},
+		[]interface{}{byte(fieldMember), variant{"s", member}},
+		[]interface{}{byte(fieldSignature), variant{"g", sig}},
+	}
+	return c.write(&message{typ: msgSignal, serial: c.serial}, fields, body.b)
+}
+
+func TestService(t *testing.T) {
+	startFakeBus(t)
+	s, err := openService("gosec-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("a"); err != ErrNotFound {
+		t.Fatalf("Get of none: %v", err)
+	}
+	for _, v := range []string{"first", "second"} {
+		if err := s.Set("a", "gosec a", v); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.Get("a"); err != nil || got != v {
+			t.Fatalf("Get: %q, %v, want %q", got, err, v)
+		}
+	}
+	if err := s.Set("b", "gosec b", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("a"); err != ErrNotFound {
+		t.Fatalf("Get of deleted: %v", err)
+	}
+	if err := s.Delete("a"); err != ErrNotFound {
+		t.Fatalf("Delete of deleted: %v", err)
+	}
+	if got, err := s.Get("b"); err != nil || got != "other" {
+		t.Fatalf("Get of other key: %q, %v", got, err)
+	}
+}
+
+// TestServicePrompt checks that a locked keyring is unlocked by a prompt,
+// for each of Get, Set and Delete
+func TestServicePrompt(t *testing.T) {
+	b := startFakeBus(t)
+	s, err := openService("gosec-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name string
+		do   func() error
+	}{
+		{"Set", func() error { return s.Set("a", "gosec a", "v") }},
+		{"Get", func() error {
+			if got, err := s.Get("a"); err != nil || got != "v" {
+				return fmt.Errorf("%q, %v", got, err)
+			}
+			return nil
+		}},
+		{"Delete", func() error { return s.Delete("a") }},
+	}
+	for i, step := range steps {
+		b.lock(false)
+		if err := step.do(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if n := b.promptsShown(); n != i+1 {
+			t.Fatalf("%s: %d prompts, want %d", step.name, n, i+1)
+		}
+	}
+
+	if err := s.Set("a", "gosec a", "v"); err != nil {
+		t.Fatal(err)
+	}
+	b.lock(true)
+	if _, err := s.Get("a"); err == nil || err == ErrNotFound {
+		t.Fatalf("Get with the prompt dismissed: %v", err)
+	}
+	if err := s.Set("a", "gosec a", "w"); err == nil {
+		t.Fatal("Set with the prompt dismissed")
+	}
+}
@@ -0,0 +1,404 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package softether
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Account files (.vpn) of the official VPN Client Manager are in the text
+// format of SoftEtherVPN configs, e.g.
+//
+//	declare root
+//	{
+//		bool CheckServerCert false
+//
+//		declare ClientAuth
+//		{
+//			uint AuthType 1
+//			byte HashedPassword 0SDhq47c2JRlDBOI8bjQn9yfRLg=
+//			string Username me
+//		}
+//		declare ClientOption
+//		{
+//			string AccountName office
+//			string Hostname vpn.example.com
+//			uint Port 443
+//			string HubName SALES
+//			...
+//		}
+//	}
+//
+// An item is "type name value", a string value is escaped as $XX for the
+// bytes of spaces, controls and '$', a lone '$' is empty, byte is base64.
+
+// Account is a connection setting of the official client
+type Account struct {
+	// Name is AccountName, shown in the VPN Client Manager
+	Name string
+	Config
+	// UseEncrypt false is accepted but not supported, as gosec only
+	// connects by SSL
+	UseEncrypt bool
+}
+
+// authSecureDevice is AuthType of a smart card, not supported
+const authSecureDevice = 4
+
+// cfgFolder is a "declare" of a config
+type cfgFolder struct {
+	name    string
+	items   []cfgItem
+	folders []*cfgFolder
+}
+
+type cfgItem struct {
+	typ, name, value string // value unescaped
+}
+
+func (f *cfgFolder) folder(name string) *cfgFolder {
+	for _, sub := range f.folders {
+		if sub.name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+func (f *cfgFolder) item(name string) (cfgItem, bool) {
+	for _, it := range f.items {
+		if it.name == name {
+			return it, true
+		}
+	}
+	return cfgItem{}, false
+}
+
+func (f *cfgFolder) str(name string) string {
+	it, _ := f.item(name)
+	return it.value
+}
+
+func (f *cfgFolder) uint(name string) (uint32, error) {
+	it, ok := f.item(name)
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(it.value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", name, err)
+	}
+	return uint32(n), nil
+}
+
+func (f *cfgFolder) bool(name string) bool {
+	return strings.EqualFold(f.str(name), "true")
+}
+
+func (f *cfgFolder) bytes(name string) ([]byte, error) {
+	v := f.str(name)
+	if v == "" || v == "$" {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return b, nil
+}
+
+func (f *cfgFolder) add(typ, name, value string) {
+	f.items = append(f.items, cfgItem{typ, name, value})
+}
+
+// cfgUnescape decodes a name or string value of a config
+func cfgUnescape(s string) (string, error) {
+	if s == "$" {
+		return "", nil
+	}
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("bad escape in %q", s)
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("bad escape in %q", s)
+		}
+		b = append(b, byte(c))
+		i += 2
+	}
+	return string(b), nil
+}
+
+// cfgEscape encodes s as a name or string value of a config
+func cfgEscape(s string) string {
+	if s == "" {
+		return "$"
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c == '$' {
+			fmt.Fprintf(&b, "$%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseCfg reads the root folder of a config
+func parseCfg(r io.Reader) (*cfgFolder, error) {
+	root := &cfgFolder{}
+	stack := []*cfgFolder{root}
+	var declared *cfgFolder // waiting for its "{"
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if n == 1 {
+			line = strings.TrimPrefix(line, "\ufeff") // BOM
+		}
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if declared != nil {
+			if line != "{" {
+				return nil, fmt.Errorf("line %d: { expected", n)
+			}
+			stack = append(stack, declared)
+			declared = nil
+			continue
+		}
+		cur := stack[len(stack)-1]
+		switch {
+		case line == "}":
+			if len(stack) == 1 {
+				return nil, fmt.Errorf("line %d: unbalanced }", n)
+			}
+			stack = stack[:len(stack)-1]
+		case fields[0] == "declare" && len(fields) == 2:
+			name, err := cfgUnescape(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			declared = &cfgFolder{name: name}
+			cur.folders = append(cur.folders, declared)
+		case len(fields) == 3:
+			name, err := cfgUnescape(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			value := fields[2]
+			if fields[0] == "string" {
+				if value, err = cfgUnescape(value); err != nil {
+					return nil, fmt.Errorf("line %d: %v", n, err)
+				}
+			}
+			cur.add(fields[0], name, value)
+		default:
+			return nil, fmt.Errorf("line %d: bad item %q", n, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(stack) != 1 || declared != nil {
+		return nil, errors.New("unexpected end of file")
+	}
+	return root, nil
+}
+
+// write writes f at depth, items first as the official client does
+func (f *cfgFolder) write(w *bytes.Buffer, depth int) {
+	indent := strings.Repeat("\t", depth)
+	fmt.Fprintf(w, "%sdeclare %s\r\n%s{\r\n", indent, cfgEscape(f.name), indent)
+	items := append([]cfgItem{}, f.items...)
+	sort.Slice(items, func(i, j int) bool { return items[i].name < items[j].name })
+	for _, it := range items {
+		value := it.value
+		if it.typ == "string" {
+			value = cfgEscape(value)
+		}
+		fmt.Fprintf(w, "%s\t%s %s %s\r\n", indent, it.typ, cfgEscape(it.name), value)
+	}
+	if len(items) > 0 && len(f.folders) > 0 {
+		w.WriteString("\r\n")
+	}
+	for _, sub := range f.folders {
+		sub.write(w, depth+1)
+	}
+	fmt.Fprintf(w, "%s}\r\n", indent)
+}
+
+// ReadAccount reads an account file exported by the VPN Client Manager. The
+// server certificate registered to be checked is pinned by Pins.
+func ReadAccount(r io.Reader) (*Account, error) {
+	cfg, err := parseCfg(r)
+	if err != nil {
+		return nil, err
+	}
+	root := cfg.folder("root")
+	if root == nil {
+		return nil, errors.New("no root declared")
+	}
+	opt, auth := root.folder("ClientOption"), root.folder("ClientAuth")
+	if opt == nil || auth == nil {
+		return nil, errors.New("no ClientOption or ClientAuth declared")
+	}
+
+	a := &Account{
+		Name:       opt.str("AccountName"),
+		UseEncrypt: opt.bool("UseEncrypt"),
+	}
+	a.Host = opt.str("Hostname")
+	if a.Host == "" {
+		return nil, errors.New("no Hostname")
+	}
+	port, err := opt.uint("Port")
+	if err != nil {
+		return nil, err
+	}
+	if port != 0 && port != 443 {
+		a.Host = net.JoinHostPort(a.Host, strconv.Itoa(int(port)))
+	}
+	a.Hub = opt.str("HubName")
+	maxConns, err := opt.uint("MaxConnection")
+	if err != nil {
+		return nil, err
+	}
+	a.MaxConnections = int(maxConns)
+	a.HalfConnection = opt.bool("HalfConnection")
+	a.Compress = opt.bool("UseCompress")
+	a.UDPAccel = !opt.bool("NoUdpAcceleration")
+	if root.bool("CheckServerCert") {
+		// the server certificate registered, pinned
+		der, err := root.bytes("ServerCert")
+		if err != nil {
+			return nil, err
+		}
+		if der != nil {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("ServerCert: %v", err)
+			}
+			a.Pins = []string{CertFingerprint(cert)}
+		}
+	}
+
+	a.User = auth.str("Username")
+	authType, err := auth.uint("AuthType")
+	if err != nil {
+		return nil, err
+	}
+	switch authType {
+	case authAnonymous:
+		a.Anonymous = true
+		a.AuthType = AuthPassword
+	case authPassword:
+		a.AuthType = AuthPassword
+		if a.HashedPassword, err = auth.bytes("HashedPassword"); err != nil {
+			return nil, err
+		}
+		if a.HashedPassword != nil && len(a.HashedPassword) != sha0Size {
+			return nil, fmt.Errorf("HashedPassword of %d bytes", len(a.HashedPassword))
+		}
+	case authPlainPassword:
+		a.AuthType = AuthPlainPassword
+		a.Password = auth.str("PlainPassword")
+	case authCert:
+		// the certificate and key are embedded, gosec takes them by files
+		a.AuthType = AuthCert
+	case authSecureDevice:
+		return nil, errors.New("smart card login not supported")
+	default:
+		return nil, fmt.Errorf("unknown AuthType %d", authType)
+	}
+	return a, nil
+}
+
+// WriteTo writes a as an account file the VPN Client Manager imports. The
+// password of AuthPassword is written hashed, by HashedPassword or else
+// Password if any. Pins and CAFile can't be written, the server certificate
+// is checked then by the official client, which asks to trust it.
+func (a *Account) WriteTo(w io.Writer) (int64, error) {
+	usr, hub := splitUserHub(a.User, a.Hub)
+	hostport := HostPort(a.Host)
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return 0, fmt.Errorf("port of %s: %v", hostport, err)
+	}
+	name := a.Name
+	if name == "" {
+		name = host
+	}
+
+	auth := &cfgFolder{name: "ClientAuth"}
+	auth.add("string", "Username", usr)
+	switch {
+	case a.Anonymous:
+		auth.add("uint", "AuthType", strconv.Itoa(authAnonymous))
+	case a.AuthType == AuthPlainPassword:
+		auth.add("uint", "AuthType", strconv.Itoa(authPlainPassword))
+		auth.add("string", "PlainPassword", a.Password)
+	case a.AuthType == AuthCert:
+		return 0, errors.New("client certificate login can't be exported")
+	default:
+		auth.add("uint", "AuthType", strconv.Itoa(authPassword))
+		hash := a.HashedPassword
+		if a.Password != "" || hash == nil {
+			hash = hashPassword(usr, a.Password)
+		}
+		auth.add("byte", "HashedPassword", base64.StdEncoding.EncodeToString(hash))
+	}
+
+	maxConns := a.MaxConnections
+	if maxConns < 1 {
+		maxConns = 1
+	}
+	opt := &cfgFolder{name: "ClientOption"}
+	opt.add("string", "AccountName", name)
+	opt.add("string", "DeviceName", "VPN")
+	opt.add("string", "Hostname", host)
+	opt.add("uint", "Port", strconv.Itoa(port))
+	opt.add("string", "HubName", hub)
+	opt.add("uint", "MaxConnection", strconv.Itoa(maxConns))
+	opt.add("uint", "AdditionalConnectionInterval", "1")
+	opt.add("bool", "UseEncrypt", "true")
+	opt.add("bool", "UseCompress", strconv.FormatBool(a.Compress))
+	opt.add("bool", "HalfConnection", strconv.FormatBool(a.HalfConnection && maxConns >= 2))
+	opt.add("bool", "NoUdpAcceleration", strconv.FormatBool(!a.UDPAccel))
+	// retry forever every 15 seconds, as gosec does
+	opt.add("uint", "NumRetry", "4294967295")
+	opt.add("uint", "RetryInterval", "15")
+
+	root := &cfgFolder{name: "root", folders: []*cfgFolder{auth, opt}}
+	root.add("bool", "CheckServerCert", strconv.FormatBool(len(a.Pins) > 0 || a.CAFile != ""))
+	root.add("bool", "StartupAccount", "false")
+
+	var buf bytes.Buffer
+	buf.WriteString("# VPN Client VPN Connection Setting File\r\n#\r\n# Exported by gosec.\r\n\r\n")
+	root.write(&buf, 0)
+	return buf.WriteTo(w)
+}
@@ -0,0 +1,222 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package softether
+
+import (
+	"bytes"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testExport is an account file laid out as the VPN Client Manager exports
+// it, with all its items, and @CERT@ for the base64 of the server certificate
+const testExport = "\ufeff# VPN Client VPN Connection Setting File\r\n" +
+	"# \r\n" +
+	"# This file is exported using the VPN Client Manager.\r\n" +
+	"# The contents of this file can be edited using a text editor.\r\n" +
+	"# \r\n" +
+	"# When this file is imported to the Client Connection Manager\r\n" +
+	"#  it can be used immediately.\r\n" +
+	"\r\n" +
+	"declare root\r\n" +
+	"{\r\n" +
+	"\tbool CheckServerCert true\r\n" +
+	"\tuint64 CreateDateTime 0\r\n" +
+	"\tuint64 LastConnectDateTime 0\r\n" +
+	"\tbyte ServerCert @CERT@\r\n" +
+	"\tbool StartupAccount false\r\n" +
+	"\tuint64 UpdateDateTime 0\r\n" +
+	"\r\n" +
+	"\tdeclare ClientAuth\r\n" +
+	"\t{\r\n" +
+	"\t\tuint AuthType 1\r\n" +
+	"\t\tbyte HashedPassword H8N7rT8BH44q0nFXC9NlFxetGzQ=\r\n" +
+	"\t\tstring Username vpn\r\n" +
+	"\t}\r\n" +
+	"\tdeclare ClientOption\r\n" +
+	"\t{\r\n" +
+	"\t\tstring AccountName Office$20VPN\r\n" +
+	"\t\tuint AdditionalConnectionInterval 1\r\n" +
+	"\t\tuint ConnectionDisconnectSpan 0\r\n" +
+	"\t\tstring DeviceName VPN\r\n" +
+	"\t\tbool DisableQoS false\r\n" +
+	"\t\tbool HalfConnection true\r\n" +
+	"\t\tbool HideNicInfoWindow false\r\n" +
+	"\t\tbool HideStatusWindow false\r\n" +
+	"\t\tstring Hostname vpn.example.com\r\n" +
+	"\t\tstring HubName SALES\r\n" +
+	"\t\tuint MaxConnection 8\r\n" +
+	"\t\tbool NoRoutingTracking false\r\n" +
+	"\t\tbool NoTls1 false\r\n" +
+	"\t\tbool NoUdpAcceleration false\r\n" +
+	"\t\tuint NumRetry 4294967295\r\n" +
+	"\t\tuint Port 5555\r\n" +
+	"\t\tuint PortUDP 0\r\n" +
+	"\t\tstring ProxyName $\r\n" +
+	"\t\tbyte ProxyPassword $\r\n" +
+	"\t\tuint ProxyPort 0\r\n" +
+	"\t\tuint ProxyType 0\r\n" +
+	"\t\tstring ProxyUsername $\r\n" +
+	"\t\tbool RequireBridgeRoutingMode false\r\n" +
+	"\t\tbool RequireMonitorMode false\r\n" +
+	"\t\tuint RetryInterval 15\r\n" +
+	"\t\tbool UseCompress true\r\n" +
+	"\t\tbool UseEncrypt true\r\n" +
+	"\t}\r\n" +
+	"}\r\n"
+
+// testAccountFile is an account file of the items given, in the folders
+// of the same name
+func testAccountFile(auth, opt string) string {
+	return "declare root\n{\n\tdeclare ClientAuth\n\t{\n" + auth + "\n\t}\n" +
+		"\tdeclare ClientOption\n\t{\n" + opt + "\n\t}\n}\n"
+}
+
+func TestReadAccount(t *testing.T) {
+	cert, fingerprint := testCert(t)
+	export := strings.Replace(testExport, "@CERT@", base64.StdEncoding.EncodeToString(cert.Certificate[0]), 1)
+	hashed, _ := base64.StdEncoding.DecodeString("H8N7rT8BH44q0nFXC9NlFxetGzQ=")
+	opt := "string Hostname vpn.example.com"
+
+	tests := []struct {
+		name string
+		file string
+		want *Account
+	}{
+		{"export", export, &Account{Name: "Office VPN", UseEncrypt: true, Config: Config{
+			Host: "vpn.example.com:5555", Hub: "SALES", User: "vpn", HashedPassword: hashed,
+			Pins: []string{fingerprint}, MaxConnections: 8, HalfConnection: true, Compress: true, UDPAccel: true,
+		}}},
+		{"not checked", strings.Replace(export, "CheckServerCert true", "CheckServerCert false", 1),
+			&Account{Name: "Office VPN", UseEncrypt: true, Config: Config{
+				Host: "vpn.example.com:5555", Hub: "SALES", User: "vpn", HashedPassword: hashed,
+				MaxConnections: 8, HalfConnection: true, Compress: true, UDPAccel: true,
+			}}},
+		{"plain", testAccountFile("uint AuthType 2\nstring PlainPassword pa$20$24s\nstring Username me",
+			"string Hostname vpn.example.com\nuint Port 443\nbool NoUdpAcceleration true"),
+			&Account{Config: Config{Host: "vpn.example.com", User: "me", AuthType: AuthPlainPassword, Password: "pa $s"}}},
+		{"anonymous", testAccountFile("uint AuthType 0", opt),
+			&Account{Config: Config{Host: "vpn.example.com", Anonymous: true, UDPAccel: true}}},
+		{"cert", testAccountFile("uint AuthType 3\nstring Username me", opt),
+			&Account{Config: Config{Host: "vpn.example.com", User: "me", AuthType: AuthCert, UDPAccel: true}}},
+		// folders not known are skipped with what they hold
+		{"nested", testAccountFile("uint AuthType 0\ndeclare ClientX\n{\ndeclare Inner\n{\nstring Hostname other\n}\n}",
+			"declare Proxy\n{\nstring Hostname proxy\n}\n"+opt),
+			&Account{Config: Config{Host: "vpn.example.com", Anonymous: true, UDPAccel: true}}},
+
+		{"no root", "declare other\n{\n}\n", nil},
+		{"no ClientOption", "declare root\n{\n\tdeclare ClientAuth\n\t{\n\t}\n}\n", nil},
+		{"no Hostname", testAccountFile("uint AuthType 0", "uint Port 443"), nil},
+		{"no {", "declare root\nbool CheckServerCert false\n", nil},
+		{"unbalanced }", testAccountFile("uint AuthType 0", opt) + "}\n", nil},
+		{"not closed", "declare root\n{\n", nil},
+		{"bad item", testAccountFile("uint AuthType", opt), nil},
+		{"bad escape", testAccountFile("uint AuthType 0", "string Hostname vpn$2"), nil},
+		{"bad escape hex", testAccountFile("uint AuthType 0", "string Hostname vpn$zz"), nil},
+		{"bad Port", testAccountFile("uint AuthType 0", opt+"\nuint Port https"), nil},
+		{"bad AuthType", testAccountFile("uint AuthType 9", opt), nil},
+		{"smart card", testAccountFile("uint AuthType 4", opt), nil},
+		{"bad base64", testAccountFile("uint AuthType 1\nbyte HashedPassword !!", opt), nil},
+		{"short hash", testAccountFile("uint AuthType 1\nbyte HashedPassword AAAA", opt), nil},
+		{"bad ServerCert", strings.Replace(testExport, "@CERT@", "AAAA", 1), nil},
+	}
+	for _, tt := range tests {
+		a, err := ReadAccount(strings.NewReader(tt.file))
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: read as %+v", tt.name, a)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(a, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, a, tt.want)
+		}
+	}
+}
+
+// TestAccountRoundTrip checks that an account exported is imported the same
+func TestAccountRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		a    Account
+		want Account
+	}{
+		{"password",
+			Account{Name: "office", UseEncrypt: true, Config: Config{Host: "vpn.example.com:5555", User: "SALES\\vpn", Password: "vpn",
+				MaxConnections: 4, HalfConnection: true, Compress: true, UDPAccel: true}},
+			Account{Name: "office", UseEncrypt: true, Config: Config{Host: "vpn.example.com:5555", Hub: "SALES", User: "vpn",
+				HashedPassword: hashPassword("vpn", "vpn"), MaxConnections: 4, HalfConnection: true, Compress: true, UDPAccel: true}}},
+		{"hashed",
+			Account{Name: "a b$c", UseEncrypt: true, Config: Config{Host: "vpn.example.com", User: "me", Hub: "HUB",
+				HashedPassword: hashPassword("me", "secret")}},
+			Account{Name: "a b$c", UseEncrypt: true, Config: Config{Host: "vpn.example.com", User: "me", Hub: "HUB",
+				HashedPassword: hashPassword("me", "secret"), MaxConnections: 1}}},
+		{"plain",
+			Account{UseEncrypt: true, Config: Config{Host: "vpn.example.com", User: "me@HUB", AuthType: AuthPlainPassword, Password: "p w"}},
+			Account{Name: "vpn.example.com", UseEncrypt: true, Config: Config{Host: "vpn.example.com", User: "me", Hub: "HUB",
+				AuthType: AuthPlainPassword, Password: "p w", MaxConnections: 1}}},
+		{"anonymous",
+			Account{UseEncrypt: true, Config: Config{Host: "vpn.example.com", Anonymous: true}},
+			Account{Name: "vpn.example.com", UseEncrypt: true, Config: Config{Host: "vpn.example.com", Hub: defaultHub,
+				Anonymous: true, MaxConnections: 1}}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if _, err := tt.a.WriteTo(&buf); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := ReadAccount(&buf)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+
+	a := Account{Config: Config{Host: "vpn.example.com", AuthType: AuthCert, CertFile: "me.p12"}}
+	if _, err := a.WriteTo(&bytes.Buffer{}); err == nil {
+		t.Error("cert login exported")
+	}
+}
+
+// TestAccountCheckServerCert checks that an account verifying the server
+// certificate is written so that the official client verifies it too
+func TestAccountCheckServerCert(t *testing.T) {
+	tests := []struct {
+		pins   []string
+		caFile string
+		check  bool
+	}{
+		{nil, "", false},
+		{[]string{"AB:CD"}, "", true},
+		{nil, "ca.pem", true},
+	}
+	for _, tt := range tests {
+		a := &Account{Name: "office", UseEncrypt: true, Config: Config{
+			Host: "vpn.example.com", User: "me", Password: "secret", Pins: tt.pins, CAFile: tt.caFile,
+		}}
+		var buf bytes.Buffer
+		if _, err := a.WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := parseCfg(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if check := cfg.folder("root").bool("CheckServerCert"); check != tt.check {
+			t.Errorf("pins %v, CA %q: CheckServerCert %v", tt.pins, tt.caFile, check)
+		}
+		if _, err := ReadAccount(bytes.NewReader(buf.Bytes())); err != nil {
+			t.Errorf("pins %v, CA %q: read back: %v", tt.pins, tt.caFile, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package softether
+
+import (
+	"crypto"
+	cryprand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// loadClientCert loads the X.509 cert and its RSA private key for cert auth,
+// either from PEM files or from a PKCS#12 (.p12/.pfx) file holding both, in
+// which case keyFile is empty. passphrase decrypts the key or PKCS#12 file.
+func loadClientCert(certFile, keyFile, passphrase string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certData, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cert *x509.Certificate
+	var key interface{}
+	ext := strings.ToLower(filepath.Ext(certFile))
+	if keyFile == "" && (ext == ".p12" || ext == ".pfx") {
+		key, cert, err = pkcs12.Decode(certData, passphrase)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", certFile, err)
+		}
+	} else {
+		if keyFile == "" {
+			// cert and key in one PEM file
+			keyFile = certFile
+		}
+		certBlock := findPEMBlock(certData, "CERTIFICATE")
+		if certBlock == nil {
+			return nil, nil, fmt.Errorf("%s: no PEM certificate", certFile)
+		}
+		if cert, err = x509.ParseCertificate(certBlock.Bytes); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", certFile, err)
+		}
+		if key, err = loadPEMKey(keyFile, passphrase); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		// SoftEtherVPN only signs with RSA
+		return nil, nil, fmt.Errorf("%T private key not supported, RSA only", key)
+	}
+	if pub, ok := cert.PublicKey.(*rsa.PublicKey); !ok || pub.N.Cmp(rsaKey.N) != 0 {
+		return nil, nil, errors.New("private key doesn't match certificate")
+	}
+	return cert, rsaKey, nil
+}
+
+func findPEMBlock(data []byte, suffix string) *pem.Block {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+		if strings.HasSuffix(block.Type, suffix) {
+			return block
+		}
+	}
+}
+
+// loadPEMKey reads a PKCS#1 or PKCS#8 private key, encrypted or not
+func loadPEMKey(keyFile, passphrase string) (interface{}, error) {
+	keyData, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block := findPEMBlock(keyData, "PRIVATE KEY")
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM private key", keyFile)
+	}
+	der := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) {
+		if der, err = x509.DecryptPEMBlock(block, []byte(passphrase)); err != nil {
+			return nil, fmt.Errorf("%s: %v", keyFile, err)
+		}
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", keyFile, err)
+	}
+	return key, nil
+}
+
+// signRandom signs the random of server hello to prove owning the key, as
+// RsaSignEx of SoftEtherVPN: PKCS#1 v1.5 over SHA-1 of the random
+func signRandom(key *rsa.PrivateKey, random []byte) ([]byte, error) {
+	h := sha1.Sum(random)
+	return rsa.SignPKCS1v15(cryprand.Reader, key, crypto.SHA1, h[:])
+}
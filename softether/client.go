@@ -0,0 +1,728 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package softether is a client of SoftEtherVPN: it logs in to a virtual hub
+// of a server over TLS and moves ethernet frames between the hub and a
+// Device like a TAP interface, keeping the tunnel up until canceled.
+//
+//	c := &softether.Client{Config: softether.Config{Host: "vpn.example.com", User: "me@hub", Password: pass}}
+//	s, err := c.Connect(ctx)
+//	if err != nil {
+//		return err
+//	}
+//	return c.Serve(ctx, s, tap)
+package softether
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/songgao/packets/ethernet"
+)
+
+// Debug logs the package in the format of fmt.Printf, nothing by default
+var Debug = func(format string, args ...interface{}) {}
+
+// Config is what a Client connects with
+type Config struct {
+	// Host is host or host:port of the server, 443 if no port
+	Host string
+	// Hub is the virtual hub to login, DEFAULT if empty and User doesn't
+	// carry it as "user@hub" or "hub\user"
+	Hub  string
+	User string
+	// Password is the passphrase of the key for AuthCert
+	Password string
+	// HashedPassword is the password of AuthPassword as SoftEtherVPN keeps
+	// it, e.g. in .vpn files, taken when Password is empty
+	HashedPassword []byte
+	// AuthType is AuthPassword, the zero value, AuthPlainPassword or AuthCert
+	AuthType int
+	// Anonymous logs in without credential, for hubs allowing anonymous users
+	Anonymous bool
+	// for AuthCert: PEM, or PKCS#12 with KeyFile empty
+	CertFile string
+	KeyFile  string // PEM
+
+	// the server certificate is verified by Pins if any, or else by CAFile,
+	// the system roots if empty, or the fingerprint KnownServer returns for
+	// host:port, trusted on first use. KnownServer may be nil.
+	CAFile      string
+	Pins        []string // SHA-256 fingerprints
+	KnownServer func(hostport string) string
+
+	// TCP connections of the session wanted, 1 if 0, the server may allow less
+	MaxConnections int
+	// HalfConnection makes each connection either upload or download, with
+	// 2 connections at least
+	HalfConnection bool
+	// Compress asks for compression of frames
+	Compress bool
+	// UDPAccel offers UDP acceleration
+	UDPAccel bool
+	// interval of keep-alive and timeout of the tunnel, 0 for the server's
+	KeepAlive, KeepAliveTimeout time.Duration
+}
+
+// Client connects to a SoftEtherVPN server by its Config
+type Client struct {
+	Config
+	// OnEvent is told the state of the tunnel served, from the goroutine of
+	// Serve which waits for it to return. It may be nil.
+	OnEvent func(Event)
+}
+
+// State is the state of the tunnel served
+type State int
+
+const (
+	// Disconnected is sent last, when all is closed
+	Disconnected State = iota
+	// Connected is sent when the tunnel is up, again after reconnecting
+	Connected
+	// Reconnecting is sent before each attempt of reconnecting a tunnel lost
+	Reconnecting
+	// Disconnecting is sent before the session and Device are closed, it is
+	// the last time frames get thru
+	Disconnecting
+)
+
+// Event tells a change of State
+type Event struct {
+	State State
+	// Session up for Connected, and for Disconnecting unless the tunnel was
+	// lost already
+	Session *Session
+	// Attempt of reconnecting, from 1
+	Attempt int
+	// Err of the server refusing to reconnect, for Disconnected, nil if
+	// Serve was canceled
+	Err error
+}
+
+// Device is where frames of the tunnel are read from and written to, one
+// ethernet frame a call, like a TAP interface. Close makes Read return.
+type Device interface {
+	io.ReadWriteCloser
+}
+
+const (
+	KeepAliveMsg = 0xffffffff
+	dialTimeout  = 15 * time.Second
+)
+
+const defaultHub = "DEFAULT"
+
+// splitUserHub returns user name and hub to login. Without hub given, usr
+// may carry it as "user@hub" or "hub\user" like the official client shows.
+func splitUserHub(usr, hub string) (string, string) {
+	if hub != "" {
+		return usr, hub
+	}
+	if i := strings.IndexByte(usr, '\\'); i > 0 && i < len(usr)-1 {
+		return usr[i+1:], usr[:i]
+	}
+	if i := strings.LastIndexByte(usr, '@'); i > 0 && i < len(usr)-1 {
+		return usr[:i], usr[i+1:]
+	}
+	return usr, defaultHub
+}
+
+// HostPort is host of server to connect, with 443 as port if no port given
+func HostPort(host string) string {
+	// a bit ugly to append port number
+	hostport := host
+	ipEnd := strings.LastIndexByte(host, ']')
+	if ipEnd != -1 {
+		Debug("with IPv6:port\n")
+	} else if off := strings.IndexByte(host, ':'); off != -1 {
+		ipEnd := strings.LastIndexByte(host, ':')
+		if ipEnd != -1 && off != ipEnd {
+			// This is IPv6 IP address without port
+			hostport = "[" + host + "]" + ":443"
+		}
+	} else {
+		hostport += ":443"
+	}
+	return hostport
+}
+
+// ServerName is the host of hostport, to verify the server certificate
+func ServerName(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
+
+// tunnelConn is a TLS connection to server, it carries packs when logging in
+// and frames after
+type tunnelConn struct {
+	conn *tls.Conn
+	// All reads of conn go through rd
+	rd    *bufio.Reader
+	myIP  string
+	hello serverHello
+	// control messages to send, see run
+	ctrl chan []byte
+	// direction of the connection in a half connection session
+	direction uint32
+	// set when frames are compressed, shared by connections of a session
+	compress *compressStats
+	// closed by close, after run
+	done      chan struct{}
+	closeOnce sync.Once
+	// closed by handshakeDone to stop the watch of the login context, which
+	// closes watched when it stops
+	handshaking   chan struct{}
+	watched       chan struct{}
+	handshakeOnce sync.Once
+}
+
+// dialServer connects to hostport, which is verified by trust, uploads the
+// watermark and reads the server hello, in dialTimeout. Until handshakeDone,
+// the packs of the login are also bounded by dialTimeout each, and the conn
+// is closed when ctx is done.
+func dialServer(ctx context.Context, hostport string, trust *Trust) (*tunnelConn, error) {
+	tlsConfig, err := trust.TLSConfig(ServerName(hostport))
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	raw, err := dialer.DialContext(ctx, "tcp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, tlsConfig)
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	Debug("conn type %T, to %v\n", conn, hostport)
+	t := &tunnelConn{conn: conn, rd: bufio.NewReader(conn)}
+	t.watch(ctx)
+	// *UntrustedCert as is if the certificate is not trusted
+	if err := conn.Handshake(); err != nil {
+		t.close()
+		return nil, ctxErr(ctx, err)
+	}
+
+	// Steps: upload signature
+	waterMarkLen, waterMarkData := getWatermarkData()
+	ipEnd := strings.LastIndexByte(conn.LocalAddr().String(), ':')
+	if ipEnd == -1 {
+		t.close()
+		return nil, errors.New("Can't get port from LocalAddr " + conn.LocalAddr().String())
+	}
+	t.myIP = conn.LocalAddr().String()[:ipEnd]
+	Debug("Connection established\n")
+	fmt.Fprintf(conn, "POST /vpnsvc/connect.cgi HTTP/1.1\r\n"+
+		"Connection: Keep-Alive\r\n"+
+		"Content-Length: %d\r\n"+
+		"Content-Type: image/jpedg\r\n"+
+		"Host: %s\r\n\r\n%s", waterMarkLen, t.myIP, waterMarkData)
+
+	Debug("TX done\n")
+	// Steps: download server hello
+	body, err := parseHttpResponse(t.rd)
+	if err == nil {
+		err = unmarshalPack(body, &t.hello)
+	}
+	if err != nil {
+		t.close()
+		return nil, ctxErr(ctx, err)
+	}
+	return t, nil
+}
+
+// watch closes t when ctx is done, until handshakeDone
+func (t *tunnelConn) watch(ctx context.Context) {
+	t.handshaking = make(chan struct{})
+	t.watched = make(chan struct{})
+	go func() {
+		defer close(t.watched)
+		select {
+		case <-ctx.Done():
+			t.conn.Close()
+		case <-t.handshaking:
+		}
+	}()
+}
+
+// handshakeDone lifts the deadline and the watch of the login context once
+// the reply of the login is parsed, frames then keep t alive
+func (t *tunnelConn) handshakeDone() {
+	t.handshakeOnce.Do(func() {
+		if t.handshaking == nil {
+			return
+		}
+		close(t.handshaking)
+		<-t.watched
+		t.conn.SetDeadline(time.Time{})
+	})
+}
+
+// ctxErr is the error of ctx once it is done, which made err by closing the
+// conn, or else err
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// postPack sends req to server and reads the reply pack into reply, which may
+// be nil if server doesn't reply
+func (t *tunnelConn) postPack(req, reply interface{}) error {
+	reqByte, err := marshalPack(req)
+	if err != nil {
+		return err
+	}
+
+	t.conn.SetDeadline(time.Now().Add(dialTimeout))
+	fmt.Fprintf(t.conn, "POST /vpnsvc/vpn.cgi HTTP/1.1\r\n"+
+		"Connection: Keep-Alive\r\n"+
+		"Content-Length: %s\r\n"+
+		"Content-Type: application/octet-stream\r\n"+
+		"Date: %s\r\n"+
+		"Host: %s\r\n"+
+		"Keep-Alive: timeout=15; max=19\r\n\r\n",
+		strconv.Itoa(len(reqByte)),
+		time.Now().Format("Mon Jan 2 15:04:05 -0700 MST 2006"),
+		t.myIP)
+	if _, err = t.conn.Write(reqByte); err != nil || reply == nil {
+		return err
+	}
+
+	body, err := parseHttpResponse(t.rd)
+	if err != nil {
+		return err
+	}
+	return unmarshalPack(body, reply)
+}
+
+// CertLoadError is returned when the client certificate can't be used
+type CertLoadError struct{ Err error }
+
+func (e CertLoadError) Error() string { return "client certificate: " + e.Err.Error() }
+
+// LoginError is the error code of server refusing login
+type LoginError uint32
+
+func (e LoginError) Error() string { return fmt.Sprintf("login refused, error %d", uint32(e)) }
+
+// refused tells if err is the server or its certificate refused, then
+// trying to connect again is no use
+func refused(err error) bool {
+	switch err := err.(type) {
+	case *UntrustedCert, CertLoadError:
+		return true
+	case LoginError:
+		return err == ErrAuthFailed
+	}
+	return false
+}
+
+// event tells OnEvent e, if set
+func (c *Client) event(e Event) {
+	if c.OnEvent != nil {
+		c.OnEvent(e)
+	}
+}
+
+// maxConns is MaxConnections within what SoftEtherVPN allows
+func (c *Client) maxConns() int {
+	if c.MaxConnections < 1 {
+		return 1
+	}
+	if c.MaxConnections > MaxConnections {
+		return MaxConnections
+	}
+	return c.MaxConnections
+}
+
+// trust returns the trust of the server certificate of hostport
+func (c *Client) trust(hostport string) *Trust {
+	trust := &Trust{CAFile: c.CAFile, Pins: c.Pins}
+	if c.KnownServer != nil {
+		trust.Known = c.KnownServer(hostport)
+	}
+	return trust
+}
+
+// newLogin returns the login for the hello of server, by ticket if the
+// server was redirected to
+func (c *Client) newLogin(hello serverHello, ticket []byte) (*loginRequest, error) {
+	var err error
+	usr, hub := splitUserHub(c.User, c.Hub)
+	Debug("login %q of hub %q\n", usr, hub)
+	login := &loginRequest{
+		HubName:       hub,
+		UserName:      usr,
+		Method:        "login",
+		Timestamp:     time.Now().Format("123456"),
+		ClientStr:     hello.Hello,
+		ClientVer:     hello.Version,
+		ClientBuild:   hello.Build,
+		MaxConnection: uint32(c.maxConns()),
+		UseEncrypt:    true,
+		UseCompress:   c.Compress,
+		// each connection one way, which needs two at least
+		HalfConnection: c.HalfConnection && c.maxConns() >= 2,
+	}
+	authType := authPassword
+	switch c.AuthType {
+	case AuthPlainPassword:
+		authType = authPlainPassword
+	case AuthCert:
+		authType = authCert
+	}
+	if c.Anonymous {
+		authType = authAnonymous
+		if login.UserName == "" {
+			// any name is fine, it is only shown in the server log
+			login.UserName = "anonymous"
+		}
+	}
+	if ticket != nil {
+		// the controller has authenticated us
+		authType = authTicket
+	}
+	login.AuthType = uint32(authType)
+	switch authType {
+	case authAnonymous:
+	case authTicket:
+		login.Ticket = ticket
+	case authPlainPassword:
+		// The server passes it to RADIUS or NT domain as is
+		login.PlainPassword = c.Password
+	case authCert:
+		// password is the passphrase of private key
+		cert, key, err := loadClientCert(c.CertFile, c.KeyFile, c.Password)
+		if err != nil {
+			return nil, CertLoadError{err}
+		}
+		login.Cert = cert.Raw
+		if login.Sign, err = signRandom(key, hello.Random); err != nil {
+			return nil, err
+		}
+	default:
+		hash := c.HashedPassword
+		if c.Password != "" || hash == nil {
+			hash = hashPassword(usr, c.Password)
+		}
+		login.SecurePassword, err = securePassword(hash, hello.Random)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return login, nil
+}
+
+// maxRedirects limits cluster redirects followed in one connect
+const maxRedirects = 4
+
+// redirectTo returns the member server a cluster controller redirects to,
+// on the port in use if the member listens on it
+func (w *welcome) redirectTo(hostport string) (string, error) {
+	ip := unpackIP(w.IP)
+	if w.IP == 0 || len(w.Ports) == 0 || len(w.Ticket) != sha0Size {
+		return "", fmt.Errorf("bad redirect to %v:%v", ip, w.Ports)
+	}
+	port := w.Ports[0]
+	if _, cur, err := net.SplitHostPort(hostport); err == nil {
+		for _, p := range w.Ports {
+			if strconv.Itoa(int(p)) == cur {
+				port = p
+			}
+		}
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
+
+// Connect logs in to the server, following cluster redirects, and opens the
+// connections of the session. The error is *UntrustedCert if the server
+// certificate is not trusted, CertLoadError if the client certificate can't
+// be used, LoginError if the server refused to login.
+func (c *Client) Connect(ctx context.Context) (*Session, error) {
+	s, err := c.login(ctx)
+	if err != nil {
+		Debug("Connection failed: %v\n", err)
+	}
+	return s, err
+}
+
+func (c *Client) login(ctx context.Context) (s *Session, err error) {
+	var t *tunnelConn
+	// Steps: offer UDP acceleration, the same port to a member redirected to
+	var udp *udpChannel
+	if c.UDPAccel {
+		var err error
+		if udp, err = newUDPChannel(); err != nil {
+			Debug("no UDP acceleration: %v\n", err)
+		}
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		if t != nil {
+			t.close()
+		}
+		if udp != nil {
+			udp.close()
+		}
+		err = ctxErr(ctx, err)
+	}()
+
+	// create connection to server, again to the member server if redirected
+	hostport := HostPort(c.Host)
+	// Steps: verify server certificate, while dialing
+	trust := c.trust(hostport)
+	var ticket []byte
+	var wel welcome
+	for hops := 0; ; hops++ {
+		if t, err = dialServer(ctx, hostport, trust); err != nil {
+			if u, ok := err.(*UntrustedCert); ok {
+				// the caller may ask the user to trust it and connect again
+				u.HostPort = hostport
+			}
+			return nil, err
+		}
+
+		// Steps: send authentication
+		login, err := c.newLogin(t.hello, ticket)
+		if err == nil {
+			if udp != nil {
+				udp.addToLogin(login, t.conn.LocalAddr())
+			}
+			wel = welcome{}
+			err = t.postPack(login, &wel)
+		}
+		if err == nil && wel.Error != 0 {
+			err = LoginError(wel.Error)
+		}
+		if err != nil {
+			return nil, err
+		}
+		Debug("Server Response from auth: %+v\n", wel)
+		if !wel.Redirect {
+			break
+		}
+
+		// Steps: follow cluster redirect
+		member, err := wel.redirectTo(hostport)
+		if err == nil && hops == maxRedirects {
+			err = errors.New("too many redirects")
+		}
+		if err != nil {
+			return nil, err
+		}
+		Debug("Redirected from %s to %s\n", hostport, member)
+		// tell the controller we leave, as the official client does
+		t.postPack(&struct{}{}, nil)
+		t.close()
+		t = nil
+
+		hostport = member
+		ticket = wel.Ticket
+		trust = c.trust(hostport)
+		if len(wel.Cert) != 0 {
+			// the member cert given by the trusted controller
+			if cert, err := x509.ParseCertificate(wel.Cert); err == nil {
+				trust.Pins = []string{CertFingerprint(cert)}
+			}
+		}
+	}
+	if t.handshakeDone(); ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	s = &Session{server: hostport, wel: wel}
+	s.fingerprint = CertFingerprint(t.conn.ConnectionState().PeerCertificates[0])
+	if wel.HalfConnection {
+		t.direction = tcpClientToServer
+	}
+
+	// Steps: open more connections of the session, as many as both allow
+	numConn := c.maxConns()
+	if int(wel.MaxConnection) < numConn {
+		numConn = int(wel.MaxConnection)
+	}
+	s.conns = []*tunnelConn{t}
+	if numConn > 1 {
+		s.conns = append(s.conns, addConnections(ctx, hostport, s.fingerprint, &wel, numConn-1)...)
+		Debug("%d connections of %d wanted\n", len(s.conns), numConn)
+	}
+	if err = ctx.Err(); err == nil {
+		err = s.setup()
+	}
+	if err != nil {
+		s.closeConns()
+		return nil, err
+	}
+
+	if udp != nil {
+		if err := udp.start(&wel, t.conn.RemoteAddr()); err != nil {
+			Debug("err: %v\n", err)
+			udp.close()
+		} else {
+			s.udp = udp
+		}
+	}
+	return s, nil
+}
+
+// resume opens connections to the session of old again, as many as it had,
+// while the server keeps the session for a while after they are lost. It
+// returns nil if the session is gone, then the login is done again.
+func (c *Client) resume(ctx context.Context, old *Session) *Session {
+	s := &Session{server: old.server, fingerprint: old.fingerprint, wel: old.wel, compress: old.compress}
+	s.conns = addConnections(ctx, s.server, s.fingerprint, &s.wel, len(old.conns))
+	if len(s.conns) == 0 {
+		return nil
+	}
+	if err := s.setup(); err != nil {
+		Debug("err: %v\n", err)
+		s.close()
+		return nil
+	}
+	Debug("session resumed with %d connections\n", len(s.conns))
+	// UDP doesn't depend on the connections
+	s.udp, old.udp = old.udp, nil
+	return s
+}
+
+// Serve moves frames between s, connected by c, and dev until ctx is done:
+// frames read from dev go over UDP acceleration when it works, over the
+// connections otherwise, frames received are written to dev. When the
+// tunnel is lost, the session is resumed or logged in again after a backoff,
+// on the same dev. It returns after all it started is done, the session and
+// dev closed and all goroutines returned, with nil when ctx is done, or the
+// error of the server refusing to login again.
+func (c *Client) Serve(ctx context.Context, s *Session, dev Device) (err error) {
+	// all goroutines of the tunnel, waited for when closing
+	var wg sync.WaitGroup
+	defer func() {
+		c.event(Event{State: Disconnecting, Session: s})
+		if s != nil {
+			s.close()
+		}
+		dev.Close()
+		wg.Wait()
+		c.event(Event{State: Disconnected, Err: err})
+		Debug("Quit connectivity\n")
+	}()
+
+	// frames read from dev wait here to be batched by connections
+	chanWrite := make(chan []byte, frameQueueLen)
+	// UDP channel of the session, which changes when logged in again
+	var udp atomic.Value
+	udp.Store((*udpChannel)(nil))
+
+	// read dev and send frame over UDP, or to chanWrite
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			var frame ethernet.Frame
+			frame.Resize(1500)
+			n, err := dev.Read([]byte(frame))
+			if err != nil {
+				Debug("iface is closed for read, quit\n")
+				return
+			}
+			//This parse is for debug only
+			//pktParse(frame[:n])
+			if udp.Load().(*udpChannel).send(frame[:n]) {
+				continue
+			}
+			select {
+			case chanWrite <- frame[:n]:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		s.run(dev, chanWrite, &wg)
+		if s.udp != nil && s.udp != udp.Load().(*udpChannel) {
+			s.udp.run(dev, &wg)
+		}
+		udp.Store(s.udp)
+		c.event(Event{State: Connected, Session: s})
+
+		// Steps: keep alive, until nothing is read for timeout
+		interval, timeout := s.keepAlive(c.KeepAlive, c.KeepAliveTimeout)
+		Debug("keep-alive every %v, timeout %v\n", interval, timeout)
+		ticker := time.NewTicker(interval)
+		for alive := true; alive; {
+			select {
+			case <-ctx.Done():
+				ticker.Stop()
+				return nil
+			case <-s.lost:
+				alive = false
+			case <-ticker.C:
+				if idle := s.idle(); idle > timeout {
+					s.lose(fmt.Errorf("nothing read for %v", idle.Round(time.Second)))
+					continue
+				}
+				//Debug("keep alive timer wake up\n")
+				for _, t := range s.conns {
+					t.sendCtrl(keepAlivePack())
+				}
+			}
+		}
+		ticker.Stop()
+
+		// Steps: reconnect after a backoff, until canceled
+		old := s
+		old.closeConns()
+		s, err = c.reconnect(ctx, old)
+		// with its UDP channel, unless resumed
+		old.close()
+		if s == nil {
+			return err
+		}
+	}
+}
+
+// reconnect resumes the session of old, or logs in again, after a backoff
+// growing with every attempt. It returns nil when ctx is done, or with the
+// error of the server refusing to login.
+func (c *Client) reconnect(ctx context.Context, old *Session) (*Session, error) {
+	for attempt := 1; ; attempt++ {
+		c.event(Event{State: Reconnecting, Attempt: attempt})
+		delay := reconnectDelay(attempt)
+		Debug("reconnect attempt %d in %v\n", attempt, delay)
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-time.After(delay):
+		}
+		if s := c.resume(ctx, old); s != nil {
+			return s, nil
+		}
+		s, err := c.login(ctx)
+		if err == nil {
+			return s, nil
+		}
+		Debug("err: %v\n", err)
+		if refused(err) {
+			// no use trying again
+			Debug("reconnect refused\n")
+			return nil, err
+		}
+	}
+}
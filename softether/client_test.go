@@ -0,0 +1,512 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package softether
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"gosec/udpaccel"
+)
+
+// testCert returns a self-signed certificate of 127.0.0.1 and its
+// fingerprint to pin
+func testCert(tb testing.TB) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, CertFingerprint(cert)
+}
+
+// fakeServer is a SoftEtherVPN server in process, which logs in anyone
+// and counts the frames received over TLS and UDP
+type fakeServer struct {
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu    sync.Mutex
+	conns []net.Conn
+	// close the UDP side of sessions
+	udpClosers []func()
+	tcpFrames  int
+	udpFrames  int
+	// half connection of the session logged in, and the messages read on
+	// its download only connections
+	half     bool
+	downMsgs int
+	// method never replied, as a stalled server
+	stall string
+}
+
+// startFakeServer starts a server on the loopback interface, and returns
+// the config to connect to it
+func startFakeServer(tb testing.TB) (*fakeServer, Config) {
+	cert, fingerprint := testCert(tb)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	f := &fakeServer{ln: ln}
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.wg.Add(1)
+			go func() {
+				defer f.wg.Done()
+				f.serve(conn)
+			}()
+		}
+	}()
+	return f, Config{Host: ln.Addr().String(), User: "me", Password: "secret", Pins: []string{fingerprint}}
+}
+
+func (f *fakeServer) reply(conn net.Conn, v interface{}) error {
+	body, err := marshalPack(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+func (f *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	f.mu.Lock()
+	f.conns = append(f.conns, conn)
+	f.mu.Unlock()
+
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	ioutil.ReadAll(req.Body)
+	if f.reply(conn, &testHello) != nil {
+		return
+	}
+	if req, err = http.ReadRequest(br); err != nil {
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	var m struct {
+		Method      string `pack:"method,str"`
+		UseCompress bool   `pack:"use_compress,int"`
+		Half        bool   `pack:"half_connection,int"`
+		UDPPort     uint32 `pack:"udp_acceleration_client_port,int"`
+		UDPKey      []byte `pack:"udp_acceleration_client_key,data"`
+	}
+	if unmarshalPack(body, &m) != nil {
+		return
+	}
+	f.mu.Lock()
+	stall := f.stall
+	f.mu.Unlock()
+	if m.Method == stall {
+		// until the client or close closes conn
+		ioutil.ReadAll(br)
+		return
+	}
+	// the login connection uploads, the others download
+	var down bool
+	switch m.Method {
+	case "login":
+		wel := &welcome{SessionKey: testWelcome.SessionKey, MaxConnection: 4, UseEncrypt: true,
+			UseCompress: m.UseCompress, HalfConnection: m.Half}
+		if m.UDPPort != 0 && f.startUDP(int(m.UDPPort), m.UDPKey, wel) != nil {
+			return
+		}
+		f.mu.Lock()
+		f.half = m.Half
+		f.mu.Unlock()
+		err = f.reply(conn, wel)
+	case "additional_connect":
+		reply := &additionalConnectReply{}
+		f.mu.Lock()
+		down = f.half
+		f.mu.Unlock()
+		if down {
+			reply.Direction = tcpServerToClient
+		}
+		err = f.reply(conn, reply)
+	default:
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	bl := newBlockReader(br)
+	if m.UseCompress {
+		bl.decomp = newFrameDecompressor(&compressStats{})
+	}
+	for bl.readMsg(func(frame []byte) error {
+		f.mu.Lock()
+		f.tcpFrames++
+		f.mu.Unlock()
+		return nil
+	}) == nil {
+		if down {
+			f.mu.Lock()
+			f.downMsgs++
+			f.mu.Unlock()
+		}
+	}
+}
+
+// startUDP accepts UDP acceleration of the client at port, in wel
+func (f *fakeServer) startUDP(port int, clientKey []byte, wel *welcome) error {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	key, err := udpaccel.NewKey()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	a, err := udpaccel.New(conn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port},
+		udpaccel.Params{MyKey: key, YourKey: clientKey, MyCookie: 7, YourCookie: 8})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	stop := make(chan struct{})
+	f.mu.Lock()
+	f.udpClosers = append(f.udpClosers, func() {
+		conn.Close()
+		close(stop)
+	})
+	f.mu.Unlock()
+	f.wg.Add(2)
+	go func() {
+		defer f.wg.Done()
+		buf := make([]byte, udpaccel.MaxPacketSize)
+		for {
+			if _, err := a.Recv(buf); err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.udpFrames++
+			f.mu.Unlock()
+		}
+	}()
+	go func() {
+		defer f.wg.Done()
+		for a.KeepAlive() == nil {
+			select {
+			case <-stop:
+				return
+			case <-time.After(udpaccel.NextKeepAlive()):
+			}
+		}
+	}()
+
+	wel.UseUDPAccel = true
+	wel.UDPAccelVersion = udpaccel.Version
+	wel.UDPAccelServerPort = uint32(conn.LocalAddr().(*net.UDPAddr).Port)
+	wel.UDPAccelServerKey = key
+	wel.UDPAccelServerCookie = 7
+	wel.UDPAccelClientCookie = 8
+	wel.UDPAccelUseEncryption = true
+	return nil
+}
+
+// frames returns the frames received over TLS and UDP
+func (f *fakeServer) frames() (tcp, udp int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tcpFrames, f.udpFrames
+}
+
+// dropConns closes the TLS connections, so that the tunnel is lost
+func (f *fakeServer) dropConns() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+// blockUDP closes the UDP side of all sessions
+func (f *fakeServer) blockUDP() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, closeUDP := range f.udpClosers {
+		closeUDP()
+	}
+	f.udpClosers = nil
+}
+
+// close stops f and waits for all its goroutines
+func (f *fakeServer) close() {
+	f.ln.Close()
+	f.dropConns()
+	f.blockUDP()
+	f.wg.Wait()
+}
+
+// testDevice is a Device whose frames to read are sent to in
+type testDevice struct {
+	in        chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newTestDevice() *testDevice {
+	return &testDevice{in: make(chan []byte, 16), closed: make(chan struct{})}
+}
+
+func (d *testDevice) Read(p []byte) (int, error) {
+	select {
+	case frame := <-d.in:
+		return copy(p, frame), nil
+	case <-d.closed:
+		return 0, errors.New("closed")
+	}
+}
+
+func (d *testDevice) Write(p []byte) (int, error) { return len(p), nil }
+
+func (d *testDevice) Close() error {
+	d.closeOnce.Do(func() { close(d.closed) })
+	return nil
+}
+
+// waitEvent waits for an event of state
+func waitEvent(t *testing.T, events <-chan Event, state State) Event {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.State == state {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("no event of state %d", state)
+		}
+	}
+}
+
+// settle waits for the goroutines to be no more than n, and returns how
+// many there are
+func settle(n int) int {
+	for i := 0; i < 100 && runtime.NumGoroutine() > n; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	return runtime.NumGoroutine()
+}
+
+// TestServeNoLeak checks that every goroutine Connect and Serve start has
+// returned once Serve returns, also after the tunnel was lost and resumed
+func TestServeNoLeak(t *testing.T) {
+	f, cfg := startFakeServer(t)
+	defer f.close()
+	cfg.MaxConnections = 3
+	cfg.Compress = true
+	cfg.UDPAccel = true
+
+	base := runtime.NumGoroutine()
+	for i := 0; i < 4; i++ {
+		events := make(chan Event, 16)
+		c := &Client{Config: cfg, OnEvent: func(e Event) { events <- e }}
+		ctx, cancel := context.WithCancel(context.Background())
+		s, err := c.Connect(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dev := newTestDevice()
+		done := make(chan error, 1)
+		go func() { done <- c.Serve(ctx, s, dev) }()
+		waitEvent(t, events, Connected)
+		dev.in <- make([]byte, 60)
+		if i%2 == 1 {
+			f.dropConns()
+			waitEvent(t, events, Reconnecting)
+			waitEvent(t, events, Connected)
+		}
+
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("Serve not returned")
+		}
+		f.dropConns()
+		f.blockUDP()
+		if n := settle(base); n > base {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("run %d: %d goroutines, %d before:\n%s", i, n, base, buf[:runtime.Stack(buf, true)])
+		}
+	}
+}
+
+// TestConnectCancel checks that Connect returns soon when its context is
+// done, while the server doesn't reply to the login or to an additional
+// connection
+func TestConnectCancel(t *testing.T) {
+	for _, method := range []string{"login", "additional_connect"} {
+		f, cfg := startFakeServer(t)
+		f.mu.Lock()
+		f.stall = method
+		f.mu.Unlock()
+		cfg.MaxConnections = 2
+
+		base := runtime.NumGoroutine()
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			s, err := (&Client{Config: cfg}).Connect(ctx)
+			if s != nil {
+				s.close()
+			}
+			done <- err
+		}()
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+		select {
+		case err := <-done:
+			if err != context.Canceled {
+				t.Errorf("%s stalled: %v", method, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s stalled: Connect not returned", method)
+		}
+		if n := settle(base); n > base {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%s stalled: %d goroutines, %d before:\n%s", method, n, base, buf[:runtime.Stack(buf, true)])
+		}
+		f.close()
+	}
+}
+
+// TestHalfKeepAlive checks that download only connections of a half
+// connection session are kept alive too
+func TestHalfKeepAlive(t *testing.T) {
+	f, cfg := startFakeServer(t)
+	defer f.close()
+	cfg.MaxConnections = 3
+	cfg.HalfConnection = true
+	cfg.KeepAlive = 50 * time.Millisecond
+
+	events := make(chan Event, 16)
+	c := &Client{Config: cfg, OnEvent: func(e Event) { events <- e }}
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := c.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up, down := s.Directions(); up != 1 || down != 2 {
+		t.Fatalf("%d up, %d down", up, down)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Serve(ctx, s, newTestDevice()) }()
+	defer func() { cancel(); <-done }()
+	waitEvent(t, events, Connected)
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		f.mu.Lock()
+		n := f.downMsgs
+		f.mu.Unlock()
+		// keep-alives go to all connections at once, 2 rounds at least
+		if n >= 4 {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("%d keep-alives on download connections", n)
+		}
+	}
+}
+
+// TestServeUDPFallback checks that frames go over UDP acceleration once it
+// works both ways, and back over TLS when the server side is blocked
+func TestServeUDPFallback(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the timeout of UDP acceleration")
+	}
+	f, cfg := startFakeServer(t)
+	defer f.close()
+	cfg.UDPAccel = true
+
+	events := make(chan Event, 16)
+	c := &Client{Config: cfg, OnEvent: func(e Event) { events <- e }}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := c.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := newTestDevice()
+	done := make(chan error, 1)
+	go func() { done <- c.Serve(ctx, s, dev) }()
+	defer func() { cancel(); <-done }()
+	waitEvent(t, events, Connected)
+
+	// sends a frame and waits for the server to receive it over udp or not
+	sendOver := func(udp bool, timeout time.Duration) {
+		tcp0, udp0 := f.frames()
+		dev.in <- make([]byte, 60)
+		for start := time.Now(); time.Since(start) < timeout; time.Sleep(10 * time.Millisecond) {
+			if tcp, udpGot := f.frames(); udp && udpGot > udp0 || !udp && tcp > tcp0 {
+				return
+			}
+		}
+		t.Fatalf("frame not received over UDP %v in %v", udp, timeout)
+	}
+	for start := time.Now(); !s.UDPReady(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 2*udpaccel.KeepAliveMax {
+			t.Fatal("UDP acceleration not ready")
+		}
+	}
+	sendOver(true, time.Second)
+
+	f.blockUDP()
+	for start := time.Now(); s.UDPReady(); time.Sleep(100 * time.Millisecond) {
+		if time.Since(start) > 2*udpaccel.DefaultTimeout {
+			t.Fatal("UDP acceleration still ready with the server blocked")
+		}
+	}
+	sendOver(false, time.Second)
+}
@@ -0,0 +1,107 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package softether
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// When both sides agree on use_compress, every block of the data format
+// carries its frame compressed by zlib, as Compress/Uncompress of SoftEtherVPN
+// do. Keep-alive messages are not compressed.
+
+// compressedMaxBlockSize is the max size of a compressed block, zlib may
+// make a frame of random data a bit larger
+const compressedMaxBlockSize = 2 * frameMaxBlockSize
+
+// compressStats counts bytes of frames before and after compression, of all
+// connections of a session
+type compressStats struct {
+	raw    uint64 // atomic
+	packed uint64 // atomic
+}
+
+func (s *compressStats) add(raw, packed int) {
+	atomic.AddUint64(&s.raw, uint64(raw))
+	atomic.AddUint64(&s.packed, uint64(packed))
+}
+
+// ratio is raw bytes per compressed byte, 0 before any frame
+func (s *compressStats) ratio() float64 {
+	packed := atomic.LoadUint64(&s.packed)
+	if packed == 0 {
+		return 0
+	}
+	return float64(atomic.LoadUint64(&s.raw)) / float64(packed)
+}
+
+// frameCompressor compresses frames written to one connection
+type frameCompressor struct {
+	buf   bytes.Buffer
+	zw    *zlib.Writer
+	stats *compressStats
+}
+
+func newFrameCompressor(stats *compressStats) *frameCompressor {
+	c := &frameCompressor{stats: stats}
+	c.zw = zlib.NewWriter(&c.buf)
+	return c
+}
+
+// compress returns frame compressed, only valid until the next call
+func (c *frameCompressor) compress(frame []byte) []byte {
+	c.buf.Reset()
+	c.zw.Reset(&c.buf)
+	// writing to bytes.Buffer doesn't fail
+	c.zw.Write(frame)
+	c.zw.Close()
+	c.stats.add(len(frame), c.buf.Len())
+	return c.buf.Bytes()
+}
+
+// frameDecompressor decompresses blocks read from one connection
+type frameDecompressor struct {
+	src   bytes.Reader
+	zr    io.ReadCloser
+	buf   [frameMaxBlockSize + 1]byte
+	stats *compressStats
+}
+
+func newFrameDecompressor(stats *compressStats) *frameDecompressor {
+	return &frameDecompressor{stats: stats}
+}
+
+// decompress returns the frame of block, only valid until the next call
+func (d *frameDecompressor) decompress(block []byte) ([]byte, error) {
+	d.src.Reset(block)
+	if d.zr == nil {
+		zr, err := zlib.NewReader(&d.src)
+		if err != nil {
+			return nil, err
+		}
+		d.zr = zr
+	} else if err := d.zr.(zlib.Resetter).Reset(&d.src, nil); err != nil {
+		return nil, err
+	}
+	n := 0
+	var err error
+	for err == nil && n < len(d.buf) {
+		var m int
+		m, err = d.zr.Read(d.buf[n:])
+		n += m
+	}
+	if n > frameMaxBlockSize {
+		return nil, fmt.Errorf("compressed block of more than %d bytes", frameMaxBlockSize)
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+	d.stats.add(n, len(block))
+	return d.buf[:n], nil
+}
@@ -0,0 +1,332 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package softether
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+/*
+Struct tags for a pack, like encoding/json:
+
+	Name   string `pack:"username,str"`
+	Ticket []byte `pack:"ticket,data,omitempty"`
+
+The first part is the elem name, the second the elem type, one of int, int64,
+data, str and unistr. Fields without tag are not part of the pack.
+Go types of fields:
+  int:    uint32, int32, uint, int, bool and slices of them
+  int64:  uint64, int64 and slices of them
+  data:   []byte, [][]byte
+  str:    string, []string
+  unistr: string, []string
+A slice other than []byte is an elem of multiple items. Elems are written in
+the order of fields, so the same struct always gives the same bytes.
+*/
+
+// packField is a tagged field of a struct
+type packField struct {
+	index     int
+	name      string
+	elemType  uint32
+	omitEmpty bool
+}
+
+var packTypeNames = map[string]uint32{
+	"int":    packInt,
+	"data":   packData,
+	"str":    packStr,
+	"unistr": packUniStr,
+	"int64":  packInt64,
+}
+
+func packFields(t reflect.Type) ([]packField, error) {
+	var fields []packField
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("pack")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		if len(parts) < 2 || parts[0] == "" {
+			return nil, fmt.Errorf("pack tag of %s.%s must be name,type", t.Name(), t.Field(i).Name)
+		}
+		elemType, ok := packTypeNames[parts[1]]
+		if !ok {
+			return nil, fmt.Errorf("pack tag of %s.%s has unknown type %q", t.Name(), t.Field(i).Name, parts[1])
+		}
+		f := packField{index: i, name: parts[0], elemType: elemType}
+		for _, opt := range parts[2:] {
+			if opt != "omitempty" {
+				return nil, fmt.Errorf("pack tag of %s.%s has unknown option %q", t.Name(), t.Field(i).Name, opt)
+			}
+			f.omitEmpty = true
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func structValue(v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return rv, errors.New("pack: nil pointer")
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return rv, fmt.Errorf("pack: %T is not a struct", v)
+	}
+	return rv, nil
+}
+
+// marshalPack returns the pack of the tagged fields of struct v
+func marshalPack(v interface{}) ([]byte, error) {
+	rv, err := structValue(v)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := packFields(rv.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	var p []byte
+	elems := 0
+	for _, f := range fields {
+		fv := rv.Field(f.index)
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		value, err := packValue(fv, f.elemType)
+		if err != nil {
+			return nil, fmt.Errorf("pack: elem %q: %v", f.name, err)
+		}
+		if p, err = addElem(p, f.name, value); err != nil {
+			return nil, err
+		}
+		elems++
+	}
+	return append(appendUint32(nil, uint32(elems)), p...), nil
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	}
+	return false
+}
+
+// packValue converts a field to the Go type addElem writes as elemType
+func packValue(v reflect.Value, elemType uint32) (interface{}, error) {
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		var items []interface{}
+		for i := 0; i < v.Len(); i++ {
+			item, err := packScalar(v.Index(i), elemType)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		switch elemType {
+		case packInt:
+			s := make([]uint32, len(items))
+			for i := range items {
+				s[i] = items[i].(uint32)
+			}
+			return s, nil
+		case packInt64:
+			s := make([]uint64, len(items))
+			for i := range items {
+				s[i] = items[i].(uint64)
+			}
+			return s, nil
+		case packData:
+			s := make([][]byte, len(items))
+			for i := range items {
+				s[i] = items[i].([]byte)
+			}
+			return s, nil
+		case packStr:
+			s := make([]string, len(items))
+			for i := range items {
+				s[i] = items[i].(string)
+			}
+			return s, nil
+		case packUniStr:
+			s := make([]uniStr, len(items))
+			for i := range items {
+				s[i] = items[i].(uniStr)
+			}
+			return s, nil
+		}
+	}
+	return packScalar(v, elemType)
+}
+
+func packScalar(v reflect.Value, elemType uint32) (interface{}, error) {
+	switch elemType {
+	case packInt:
+		switch v.Kind() {
+		case reflect.Bool:
+			if v.Bool() {
+				return uint32(1), nil
+			}
+			return uint32(0), nil
+		case reflect.Int, reflect.Int32:
+			return uint32(v.Int()), nil
+		case reflect.Uint, reflect.Uint32:
+			return uint32(v.Uint()), nil
+		}
+	case packInt64:
+		switch v.Kind() {
+		case reflect.Int64:
+			return uint64(v.Int()), nil
+		case reflect.Uint64:
+			return v.Uint(), nil
+		}
+	case packData:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Bytes(), nil
+		}
+	case packStr:
+		if v.Kind() == reflect.String {
+			return v.String(), nil
+		}
+	case packUniStr:
+		if v.Kind() == reflect.String {
+			return uniStr(v.String()), nil
+		}
+	}
+	return nil, fmt.Errorf("%v can't be elem type %d", v.Type(), elemType)
+}
+
+// unmarshalPack parses body into the tagged fields of the struct v points to.
+// Elems missing in body leave their fields untouched, elems without field are
+// ignored.
+func unmarshalPack(body []byte, v interface{}) error {
+	if reflect.ValueOf(v).Kind() != reflect.Ptr {
+		return fmt.Errorf("pack: %T is not a pointer", v)
+	}
+	m, err := parseData(body)
+	if err != nil {
+		return err
+	}
+	return unmarshalPackMap(m, v)
+}
+
+// unmarshalPackMap is unmarshalPack of an already parsed pack
+func unmarshalPackMap(m map[string]interface{}, v interface{}) error {
+	rv, err := structValue(v)
+	if err != nil {
+		return err
+	}
+	fields, err := packFields(rv.Type())
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		value, ok := m[f.name]
+		if !ok {
+			// SoftEtherVPN takes names in any case
+			for name, v := range m {
+				if strings.EqualFold(name, f.name) {
+					value, ok = v, true
+				}
+			}
+		}
+		if !ok {
+			continue
+		}
+		if err := setPackValue(rv.Field(f.index), value); err != nil {
+			return fmt.Errorf("pack: elem %q: %v", f.name, err)
+		}
+	}
+	return nil
+}
+
+// setPackValue stores a value of parseData into a field. A single item can
+// be stored into a slice field and a slice of one item into a scalar field.
+func setPackValue(v reflect.Value, value interface{}) error {
+	items := reflect.ValueOf(value)
+	isMulti := items.Kind() == reflect.Slice && items.Type().Elem().Kind() != reflect.Uint8
+	isBytes := v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8
+	if v.Kind() == reflect.Slice && !isBytes {
+		if !isMulti {
+			items = reflect.Append(reflect.MakeSlice(reflect.SliceOf(items.Type()), 0, 1), items)
+		}
+		s := reflect.MakeSlice(v.Type(), items.Len(), items.Len())
+		for i := 0; i < items.Len(); i++ {
+			if err := setPackScalar(s.Index(i), items.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	}
+	if isMulti {
+		if items.Len() != 1 {
+			return fmt.Errorf("%d items for %v", items.Len(), v.Type())
+		}
+		value = items.Index(0).Interface()
+	}
+	return setPackScalar(v, value)
+}
+
+func setPackScalar(v reflect.Value, value interface{}) error {
+	switch value := value.(type) {
+	case uint32:
+		switch v.Kind() {
+		case reflect.Bool:
+			v.SetBool(value != 0)
+			return nil
+		case reflect.Int32:
+			v.SetInt(int64(int32(value)))
+			return nil
+		case reflect.Int, reflect.Int64:
+			v.SetInt(int64(value))
+			return nil
+		case reflect.Uint, reflect.Uint32, reflect.Uint64:
+			v.SetUint(uint64(value))
+			return nil
+		}
+	case uint64:
+		switch v.Kind() {
+		case reflect.Int64:
+			v.SetInt(int64(value))
+			return nil
+		case reflect.Uint64:
+			v.SetUint(value)
+			return nil
+		}
+	case []byte:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(value)
+			return nil
+		}
+	case string:
+		if v.Kind() == reflect.String {
+			v.SetString(value)
+			return nil
+		}
+	case uniStr:
+		if v.Kind() == reflect.String {
+			v.SetString(string(value))
+			return nil
+		}
+	}
+	return fmt.Errorf("%T can't be stored in %v", value, v.Type())
+}
@@ -0,0 +1,166 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package softether
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testLogin = loginRequest{
+	Method:         "login",
+	HubName:        "SALES",
+	UserName:       "me",
+	AuthType:       authPassword,
+	SecurePassword: bytes.Repeat([]byte{0x11}, sha0Size),
+	Timestamp:      "123456",
+	ClientStr:      testHello.Hello,
+	ClientVer:      testHello.Version,
+	ClientBuild:    testHello.Build,
+	MaxConnection:  2,
+	UseEncrypt:     true,
+	HalfConnection: true,
+}
+
+// packGoldens are packs as SoftEtherVPN reads and writes them, each elem as
+// name length plus 1 | name | type | number of items | items
+var packGoldens = []struct {
+	name   string
+	v      interface{}
+	golden []string
+}{
+	{
+		"serverHello", testHello,
+		[]string{
+			// 4 elems
+			"00000004",
+			// hello
+			"00000006 68656c6c6f 00000002 00000001 00000026 536f667445746865722056504e2053657276657220446576656c6f7065722045646974696f6e",
+			// version
+			"00000008 76657273696f6e 00000000 00000001 000001b6",
+			// build
+			"00000006 6275696c64 00000000 00000001 00002620",
+			// random
+			"00000007 72616e646f6d 00000001 00000001 00000014 5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a",
+		},
+	},
+	{
+		"loginRequest", testLogin,
+		[]string{
+			// 13 elems
+			"0000000d",
+			// method
+			"00000007 6d6574686f64 00000002 00000001 00000005 6c6f67696e",
+			// hubname
+			"00000008 6875626e616d65 00000002 00000001 00000005 53414c4553",
+			// username
+			"00000009 757365726e616d65 00000002 00000001 00000002 6d65",
+			// authtype
+			"00000009 6175746874797065 00000000 00000001 00000001",
+			// secure_password
+			"00000010 7365637572655f70617373776f7264 00000001 00000001 00000014 1111111111111111111111111111111111111111",
+			// timestamp
+			"0000000a 74696d657374616d70 00000002 00000001 00000006 313233343536",
+			// client_str
+			"0000000b 636c69656e745f737472 00000002 00000001 00000026 536f667445746865722056504e2053657276657220446576656c6f7065722045646974696f6e",
+			// client_ver
+			"0000000b 636c69656e745f766572 00000000 00000001 000001b6",
+			// client_build
+			"0000000d 636c69656e745f6275696c64 00000000 00000001 00002620",
+			// max_connection
+			"0000000f 6d61785f636f6e6e656374696f6e 00000000 00000001 00000002",
+			// use_encrypt
+			"0000000c 7573655f656e6372797074 00000000 00000001 00000001",
+			// use_compress
+			"0000000d 7573655f636f6d7072657373 00000000 00000001 00000000",
+			// half_connection
+			"00000010 68616c665f636f6e6e656374696f6e 00000000 00000001 00000001",
+		},
+	},
+	{
+		"welcome", testWelcome,
+		[]string{
+			// 22 elems
+			"00000016",
+			// error
+			"00000006 6572726f72 00000000 00000001 00000000",
+			// session_name
+			"0000000d 73657373696f6e5f6e616d65 00000002 00000001 0000000e 5349442d4d452d5b56504e5d2d31",
+			// connection_name
+			"00000010 636f6e6e656374696f6e5f6e616d65 00000002 00000001 00000005 4349442d32",
+			// session_key
+			"0000000c 73657373696f6e5f6b6579 00000001 00000001 00000014 a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5a5",
+			// max_connection
+			"0000000f 6d61785f636f6e6e656374696f6e 00000000 00000001 00000008",
+			// use_encrypt
+			"0000000c 7573655f656e6372797074 00000000 00000001 00000001",
+			// use_compress
+			"0000000d 7573655f636f6d7072657373 00000000 00000001 00000001",
+			// half_connection
+			"00000010 68616c665f636f6e6e656374696f6e 00000000 00000001 00000000",
+			// timeout
+			"00000008 74696d656f7574 00000000 00000001 00004e20",
+			// Redirect
+			"00000009 5265646972656374 00000000 00000001 00000000",
+			// Ip
+			"00000003 4970 00000000 00000001 00000000",
+			// Port
+			"00000005 506f7274 00000000 00000002 000001bb000003e0",
+			// Ticket
+			"00000007 5469636b6574 00000001 00000001 00000000",
+			// Cert
+			"00000005 43657274 00000001 00000001 00000000",
+			// use_udp_acceleration
+			"00000015 7573655f7564705f616363656c65726174696f6e 00000000 00000001 00000001",
+			// udp_acceleration_version
+			"00000019 7564705f616363656c65726174696f6e5f76657273696f6e 00000000 00000001 00000001",
+			// udp_acceleration_server_ip
+			"0000001b 7564705f616363656c65726174696f6e5f7365727665725f6970 00000000 00000001 00000000",
+			// udp_acceleration_server_port
+			"0000001d 7564705f616363656c65726174696f6e5f7365727665725f706f7274 00000000 00000001 00009c40",
+			// udp_acceleration_server_key
+			"0000001c 7564705f616363656c65726174696f6e5f7365727665725f6b6579 00000001 00000001 00000014 3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c3c",
+			// udp_acceleration_server_cookie
+			"0000001f 7564705f616363656c65726174696f6e5f7365727665725f636f6f6b6965 00000000 00000001 00000007",
+			// udp_acceleration_client_cookie
+			"0000001f 7564705f616363656c65726174696f6e5f636c69656e745f636f6f6b6965 00000000 00000001 00000008",
+			// udp_acceleration_use_encryption
+			"00000020 7564705f616363656c65726174696f6e5f7573655f656e6372797074696f6e 00000000 00000001 00000001",
+		},
+	},
+}
+
+func TestMarshalPackGolden(t *testing.T) {
+	for _, tt := range packGoldens {
+		golden, err := hex.DecodeString(strings.Replace(strings.Join(tt.golden, ""), " ", "", -1))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		body, err := marshalPack(tt.v)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(body, golden) {
+			t.Errorf("%s: marshaled as\n%x\nwant\n%x", tt.name, body, golden)
+		}
+
+		got := reflect.New(reflect.TypeOf(tt.v))
+		if err := unmarshalPack(golden, got.Interface()); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if w, ok := got.Interface().(*welcome); ok {
+			// an empty data elem is read as empty bytes, not nil
+			if len(w.Ticket) == 0 && len(w.Cert) == 0 {
+				w.Ticket, w.Cert = nil, nil
+			}
+		}
+		if !reflect.DeepEqual(got.Elem().Interface(), tt.v) {
+			t.Errorf("%s: unmarshaled as %+v\nwant %+v", tt.name, got.Elem().Interface(), tt.v)
+		}
+	}
+}
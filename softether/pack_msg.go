@@ -0,0 +1,120 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package softether
+
+// Packs exchanged with SoftEtherVPN server when connecting, see
+// pack_marshal.go for the tags.
+
+// serverHello is the first pack from server, after the watermark is uploaded
+type serverHello struct {
+	Hello   string `pack:"hello,str"`
+	Version uint32 `pack:"version,int"`
+	Build   uint32 `pack:"build,int"`
+	Random  []byte `pack:"random,data"`
+}
+
+// loginRequest is sent to login a hub
+type loginRequest struct {
+	Method   string `pack:"method,str"`
+	HubName  string `pack:"hubname,str"`
+	UserName string `pack:"username,str"`
+	AuthType uint32 `pack:"authtype,int"`
+	// one of them by AuthType
+	SecurePassword []byte `pack:"secure_password,data,omitempty"`
+	PlainPassword  string `pack:"plain_password,str,omitempty"`
+	Cert           []byte `pack:"cert,data,omitempty"` // X.509 DER
+	Sign           []byte `pack:"sign,data,omitempty"` // of hello random
+	Ticket         []byte `pack:"ticket,data,omitempty"`
+	Timestamp      string `pack:"timestamp,str"`
+	ClientStr      string `pack:"client_str,str"`
+	ClientVer      uint32 `pack:"client_ver,int"`
+	ClientBuild    uint32 `pack:"client_build,int"`
+	// Add more control option if needed
+	MaxConnection  uint32 `pack:"max_connection,int"`
+	UseEncrypt     bool   `pack:"use_encrypt,int"`
+	UseCompress    bool   `pack:"use_compress,int"`
+	HalfConnection bool   `pack:"half_connection,int"`
+	// UDP acceleration offered, ClientIP is of the TLS connection
+	UseUDPAccel        bool   `pack:"use_udp_acceleration,int,omitempty"`
+	UDPAccelVersion    uint32 `pack:"udp_acceleration_version,int,omitempty"`
+	UDPAccelClientIP   uint32 `pack:"udp_acceleration_client_ip,int,omitempty"`
+	UDPAccelClientPort uint32 `pack:"udp_acceleration_client_port,int,omitempty"`
+	UDPAccelClientKey  []byte `pack:"udp_acceleration_client_key,data,omitempty"`
+}
+
+// welcome is the reply to loginRequest, Error is set when login failed
+type welcome struct {
+	Error          uint32 `pack:"error,int"`
+	SessionName    string `pack:"session_name,str"`
+	ConnectionName string `pack:"connection_name,str"`
+	SessionKey     []byte `pack:"session_key,data"`
+	MaxConnection  uint32 `pack:"max_connection,int"`
+	UseEncrypt     bool   `pack:"use_encrypt,int"`
+	UseCompress    bool   `pack:"use_compress,int"`
+	HalfConnection bool   `pack:"half_connection,int"`
+	Timeout        uint32 `pack:"timeout,int"`
+	// A cluster controller redirects to a member server, the login there
+	// is by Ticket. Cert is of the member server.
+	Redirect bool     `pack:"Redirect,int"`
+	IP       uint32   `pack:"Ip,int"`
+	Ports    []uint32 `pack:"Port,int"`
+	Ticket   []byte   `pack:"Ticket,data"`
+	Cert     []byte   `pack:"Cert,data"`
+	// UDP acceleration accepted, ServerIP is 0 for the one connected
+	UseUDPAccel           bool   `pack:"use_udp_acceleration,int"`
+	UDPAccelVersion       uint32 `pack:"udp_acceleration_version,int"`
+	UDPAccelServerIP      uint32 `pack:"udp_acceleration_server_ip,int"`
+	UDPAccelServerPort    uint32 `pack:"udp_acceleration_server_port,int"`
+	UDPAccelServerKey     []byte `pack:"udp_acceleration_server_key,data"`
+	UDPAccelServerCookie  uint32 `pack:"udp_acceleration_server_cookie,int"`
+	UDPAccelClientCookie  uint32 `pack:"udp_acceleration_client_cookie,int"`
+	UDPAccelUseEncryption bool   `pack:"udp_acceleration_use_encryption,int"`
+}
+
+// additionalConnectRequest adds a connection to the session of SessionKey,
+// which is from welcome
+type additionalConnectRequest struct {
+	Method      string `pack:"method,str"`
+	SessionKey  []byte `pack:"session_key,data"`
+	ClientStr   string `pack:"client_str,str"`
+	ClientVer   uint32 `pack:"client_ver,int"`
+	ClientBuild uint32 `pack:"client_build,int"`
+}
+
+// additionalConnectReply is the reply to additionalConnectRequest,
+// Direction is the one of the connection for a half connection session
+type additionalConnectReply struct {
+	Error     uint32 `pack:"error,int"`
+	Direction uint32 `pack:"direction,int"`
+}
+
+// Directions of a connection, as data flows
+const (
+	tcpBoth           = 0
+	tcpServerToClient = 1 // download only
+	tcpClientToServer = 2 // upload only, the first connection of a half connection session
+)
+
+// AuthType of Config, the zero value logs in by password. Anonymous login
+// is by Anonymous of Config.
+const (
+	AuthPassword      = iota // hashed
+	AuthPlainPassword        // for RADIUS and NT domain
+	AuthCert                 // client certificate
+)
+
+// Auth types of loginRequest, and AuthType of account files
+const (
+	authAnonymous     = 0  // UserName only
+	authPassword      = 1  // hashed, SecurePassword
+	authPlainPassword = 2  // PlainPassword
+	authCert          = 3  // Cert and Sign
+	authTicket        = 99 // Ticket, on a member server a cluster redirects to
+)
+
+// Error codes of SoftEtherVPN used by the client
+const (
+	ErrAuthFailed LoginError = 9
+)
@@ -0,0 +1,579 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package softether
+
+import (
+	"bufio"
+	"bytes"
+	cryprand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const httpPackRandSizeMax = 1000
+
+func getWatermarkData() (int, []byte) {
+	c := rand.Intn(httpPackRandSizeMax)
+	b := make([]byte, c)
+	_, err := cryprand.Read(b)
+	if err != nil {
+		Debug("error:", err)
+		return 0, nil
+	}
+	waterMark := append(waterMarkBase, b...)
+	return (c + len(waterMarkBase)), waterMark
+}
+
+// hashPassword is how SoftEtherVPN keeps a password:
+// SHA-0 of the password followed by the upper case user name, of which only
+// ASCII letters are changed as StrUpper of SoftEtherVPN does
+func hashPassword(usr, passwd string) []byte {
+	upper := []byte(usr)
+	for i, c := range upper {
+		if 'a' <= c && c <= 'z' {
+			upper[i] = c - 'a' + 'A'
+		}
+	}
+	h := sha0Sum(append([]byte(passwd), upper...))
+	return h[:]
+}
+
+// securePassword mixes the password hash with the random from server hello,
+// so the password hash itself is never sent
+func securePassword(hash, random []byte) ([]byte, error) {
+	if len(hash) != sha0Size || len(random) != sha0Size {
+		return nil, fmt.Errorf("password hash of %d bytes, random of %d bytes", len(hash), len(random))
+	}
+	h := sha0Sum(append(append([]byte{}, hash...), random...))
+	return h[:], nil
+}
+
+/*
+SoftEtherVPN PackToBuf format, but it should use protobuf for better :
+ number_elems (4) | Elem 1 | Elem 2 | ...|
+Where Elem n as:
+  len of name + 1 (4) | name | type (4) | num of items (4) | item 1 | item 2 | ...|
+Where all items of an elem have the type of the elem, item n as:
+  int (4) or int64 (8) or data (size|body) or string (size|str) or unistring (size|utf-8 str|0)
+*/
+const (
+	packInt    = 0
+	packData   = 1
+	packStr    = 2
+	packUniStr = 3
+	packInt64  = 4
+)
+
+// uniStr is the value of an unistr elem, it is kept apart from string
+// so that an unistr read from server is written back as unistr.
+type uniStr string
+
+// Limits when parsing a pack, the lengths inside come from the server and
+// must not be trusted, values follow SoftEtherVPN's own limits.
+const (
+	packMaxSize    = 16 * 1024 * 1024 // whole pack body
+	packMaxElems   = 262144
+	packMaxNameLen = 63
+	packMaxItems   = 262144 // items of one elem
+)
+
+// packReader reads big endian fields of a pack, each read is checked against
+// the bytes left. The first failure is kept in err and later reads return zero
+// values, so a parser only has to check err when it is going to use a value.
+type packReader struct {
+	p   []byte
+	err error
+}
+
+func (r *packReader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf("pack: "+format, args...)
+	}
+}
+
+func (r *packReader) next(n uint64, what string) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.p)) {
+		r.fail("%s needs %d bytes, only %d left", what, n, len(r.p))
+		return nil
+	}
+	b := r.p[:n]
+	r.p = r.p[n:]
+	return b
+}
+
+func (r *packReader) uint32(what string) uint32 {
+	b := r.next(4, what)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *packReader) uint64(what string) uint64 {
+	b := r.next(8, what)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// item reads a size prefixed item
+func (r *packReader) item(what string) []byte {
+	size := r.uint32(what + " size")
+	if r.err == nil && size > packMaxSize {
+		r.fail("%s size %d over limit", what, size)
+	}
+	return r.next(uint64(size), what)
+}
+
+// parseData returns the elems of a pack by name. An elem with one item is
+// stored as uint32, []byte, string, uniStr or uint64, an elem with none or
+// several items as a slice of these, e.g. []string.
+// Item bytes are copied, so the result doesn't keep body alive.
+func parseData(body []byte) (map[string]interface{}, error) {
+	Debug("Parsing data of %d bytes...\n", len(body))
+	if len(body) > packMaxSize {
+		return nil, fmt.Errorf("pack: size %d over limit", len(body))
+	}
+	r := &packReader{p: body}
+	elems := r.uint32("number of elems")
+	if r.err == nil && elems > packMaxElems {
+		r.fail("%d elems over limit", elems)
+	}
+	m := make(map[string]interface{})
+	for i := uint32(0); r.err == nil && i < elems; i++ {
+		nameLen := r.uint32("name length")
+		if r.err != nil {
+			break
+		}
+		if nameLen <= 1 || nameLen-1 > packMaxNameLen {
+			r.fail("elem %d has bad name length %d", i, nameLen)
+			break
+		}
+		name := string(r.next(uint64(nameLen-1), "name")) // nameLen is plus 1
+		elemType := r.uint32("type of " + name)
+		numItems := r.uint32("number of items of " + name)
+		if r.err != nil {
+			break
+		}
+		Debug("name %v, type %v, numItems %v\n", name, elemType, numItems)
+		// every item takes 4 bytes at least, so allocation is bounded by body
+		if numItems > packMaxItems || uint64(numItems)*4 > uint64(len(r.p)) {
+			r.fail("elem %q has bad number of items %d", name, numItems)
+			break
+		}
+		if _, ok := m[name]; ok {
+			r.fail("elem %q appears twice", name)
+			break
+		}
+
+		var value interface{}
+		switch elemType {
+		case packInt:
+			items := make([]uint32, numItems)
+			for i := range items {
+				items[i] = r.uint32(name)
+			}
+			value = items
+			if numItems == 1 {
+				value = items[0]
+			}
+		case packData:
+			items := make([][]byte, numItems)
+			for i := range items {
+				items[i] = append([]byte{}, r.item(name)...)
+			}
+			value = items
+			if numItems == 1 {
+				value = items[0]
+			}
+		case packStr:
+			items := make([]string, numItems)
+			for i := range items {
+				items[i] = string(r.item(name))
+			}
+			value = items
+			if numItems == 1 {
+				value = items[0]
+			}
+		case packUniStr:
+			items := make([]uniStr, numItems)
+			for i := range items {
+				item := r.item(name)
+				// utf-8 str is terminated by 0, which is counted in size
+				if end := bytes.IndexByte(item, 0); end != -1 {
+					item = item[:end]
+				}
+				items[i] = uniStr(item)
+			}
+			value = items
+			if numItems == 1 {
+				value = items[0]
+			}
+		case packInt64:
+			items := make([]uint64, numItems)
+			for i := range items {
+				items[i] = r.uint64(name)
+			}
+			value = items
+			if numItems == 1 {
+				value = items[0]
+			}
+		default:
+			r.fail("elem %q has unknown type %d", name, elemType)
+		}
+		m[name] = value
+	}
+	if r.err != nil {
+		Debug("err: %v\n", r.err)
+		return nil, r.err
+	}
+	if len(r.p) != 0 {
+		// SoftEtherVPN ignores them as well
+		Debug("%d bytes left after %d elems\n", len(r.p), elems)
+	}
+	return m, nil
+}
+
+func addData(p []byte, m map[string]interface{}) ([]byte, error) {
+
+	var tmp32 []byte = make([]byte, 4)
+
+	//num of elems
+	elems := len(m)
+	binary.BigEndian.PutUint32(tmp32, uint32(elems))
+	p = append(p, tmp32...)
+
+	// loop for each elem, in order of name so the same map gives the same bytes
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var err error
+		p, err = addElem(p, k, m[k])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// addElem appends one elem, the Go type of v decides the elem type,
+// a slice is written as an elem with multiple items.
+func addElem(p []byte, k string, v interface{}) ([]byte, error) {
+	//name len
+	p = appendUint32(p, uint32(len(k)+1))
+	//name str
+	p = append(p, k...)
+
+	Debug("k is %s, v type %T\n", k, v)
+
+	switch v := v.(type) {
+	case nil:
+		return nil, errors.New("nil value")
+	case int32:
+		p = intHelper(p, uint32(v))
+	case uint32:
+		p = intHelper(p, uint32(v))
+	case int: //can combine?
+		p = intHelper(p, uint32(v))
+	case uint: //can combine?
+		p = intHelper(p, uint32(v))
+	case int64:
+		p = elemHeader(p, packInt64, 1)
+		p = appendUint64(p, uint64(v))
+	case uint64:
+		p = elemHeader(p, packInt64, 1)
+		p = appendUint64(p, v)
+	case []byte:
+		p = elemHeader(p, packData, 1)
+		p = appendItem(p, v)
+	case string:
+		p = elemHeader(p, packStr, 1)
+		p = appendItem(p, []byte(v))
+	case uniStr:
+		p = elemHeader(p, packUniStr, 1)
+		p = appendUniStr(p, v)
+	case []uint32:
+		p = elemHeader(p, packInt, len(v))
+		for _, item := range v {
+			p = appendUint32(p, item)
+		}
+	case []int:
+		p = elemHeader(p, packInt, len(v))
+		for _, item := range v {
+			p = appendUint32(p, uint32(item))
+		}
+	case []uint64:
+		p = elemHeader(p, packInt64, len(v))
+		for _, item := range v {
+			p = appendUint64(p, item)
+		}
+	case []int64:
+		p = elemHeader(p, packInt64, len(v))
+		for _, item := range v {
+			p = appendUint64(p, uint64(item))
+		}
+	case [][]byte:
+		p = elemHeader(p, packData, len(v))
+		for _, item := range v {
+			p = appendItem(p, item)
+		}
+	case []string:
+		p = elemHeader(p, packStr, len(v))
+		for _, item := range v {
+			p = appendItem(p, []byte(item))
+		}
+	case []uniStr:
+		p = elemHeader(p, packUniStr, len(v))
+		for _, item := range v {
+			p = appendUniStr(p, item)
+		}
+	default:
+		Debug("Unreconized type %T\n", v)
+		return nil, errors.New("Unrecognized type")
+	}
+	return p, nil
+}
+
+func elemHeader(p []byte, elemType uint32, numItems int) []byte {
+	p = appendUint32(p, elemType)
+	return appendUint32(p, uint32(numItems))
+}
+
+func appendUint32(p []byte, v uint32) []byte {
+	var tmp32 [4]byte
+	binary.BigEndian.PutUint32(tmp32[:], v)
+	return append(p, tmp32[:]...)
+}
+
+func appendUint64(p []byte, v uint64) []byte {
+	var tmp64 [8]byte
+	binary.BigEndian.PutUint64(tmp64[:], v)
+	return append(p, tmp64[:]...)
+}
+
+func appendItem(p []byte, item []byte) []byte {
+	p = appendUint32(p, uint32(len(item)))
+	return append(p, item...)
+}
+
+// appendUniStr appends an unistr item, whose size counts the ending 0
+func appendUniStr(p []byte, s uniStr) []byte {
+	p = appendUint32(p, uint32(len(s)+1))
+	p = append(p, s...)
+	return append(p, 0)
+}
+
+// parseHttpResponse reads one response from r and returns its body. r is kept
+// by the caller for the rest of the connection, so that nothing read ahead is
+// lost.
+func parseHttpResponse(r *bufio.Reader) ([]byte, error) {
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		Debug("err: %v\n", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.Proto != "HTTP/1.1" || resp.Status != "200 OK" || resp.Header.Get("Content-Type") != "application/octet-stream" {
+		Debug("Not OK from server %v", resp)
+		return nil, errors.New("HTTP heahder not good")
+	}
+	if resp.ContentLength < 0 || resp.ContentLength > packMaxSize {
+		return nil, fmt.Errorf("HTTP Content-Length %d not acceptable", resp.ContentLength)
+	}
+	body := make([]byte, resp.ContentLength)
+	if _, err = io.ReadFull(resp.Body, body); err != nil {
+		Debug("err: %v\n", err)
+		return nil, err
+	}
+	return body, nil
+}
+
+func pktParse(frame []byte) {
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	if arpLayer := packet.Layer(layers.LayerTypeARP); arpLayer != nil {
+		Debug("This is an arpLayer packet!\n")
+
+		arp := arpLayer.(*layers.ARP)
+		Debug("ARP %v, from %v(%v) to %v(%v)\n", arp.Operation, net.IP(arp.SourceProtAddress), net.HardwareAddr(arp.SourceHwAddress), net.IP(arp.DstProtAddress), net.HardwareAddr(arp.DstHwAddress))
+
+	} else if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+		Debug("This is an ipLayer packet!\n")
+
+		ip := ipLayer.(*layers.IPv4)
+
+		Debug("iPv4 protocol %d, from %v to %v\n", ip.Protocol, net.IP(ip.SrcIP), net.IP(ip.DstIP))
+
+	}
+	return
+}
+
+// looks like combine int/uint/32 as one case will have error of
+//"cannot convert v (type interface {}) to type uint32: need type assertion", so make a helper
+func intHelper(p []byte, v uint32) []byte {
+	p = elemHeader(p, packInt, 1)
+	return appendUint32(p, v)
+}
+
+/* data format:
+   | number of blocks | block 1 | block 2 | ...|
+   Where number of blocks = 0xfff...f is a special magic for keep-alive,
+   followed by | size | random data |,
+      = 0xfff...e is for control msg, since there won't be so large a block size.
+   Then block is:
+   | size of block | data |
+*/
+func framePack(numBlock, size_block int, data []byte) []byte {
+	var frameSent []byte
+	var tmp32 []byte = make([]byte, 4)
+	binary.BigEndian.PutUint32(tmp32, uint32(numBlock)) // num of blocks
+	frameSent = append(frameSent, tmp32...)
+	binary.BigEndian.PutUint32(tmp32, uint32(size_block)) // size of block
+	frameSent = append(frameSent, tmp32...)
+	frameSent = append(frameSent, data...) //data
+	return frameSent
+}
+
+// keepAlivePack is a keep-alive message of random size and data, as the
+// official client sends, so that it doesn't look the same every time
+func keepAlivePack() []byte {
+	data := make([]byte, rand.Intn(keepAliveMaxSize))
+	rand.Read(data)
+	return framePack(KeepAliveMsg, len(data), data)
+}
+
+// Batching of frames written to the tunnel
+const (
+	frameQueueLen = 256       // frames read from TAP waiting to be written
+	batchMaxSize  = 64 * 1024 // bytes of a message of many blocks
+)
+
+// batchFrames returns one message of first and the frames already queued in
+// frames, up to batchMaxSize. It never waits for more frames, so it adds no
+// latency, but under bulk traffic frames queue while the previous message is
+// written and are then sent in one TLS write instead of one each.
+// Frames are compressed by comp unless it is nil.
+func batchFrames(first []byte, frames <-chan []byte, comp *frameCompressor) []byte {
+	msg := make([]byte, 4, 4+2*(4+frameMaxBlockSize))
+	if comp != nil {
+		first = comp.compress(first)
+	}
+	msg = appendItem(msg, first)
+	numBlock := 1
+	for more := true; more && numBlock < frameMaxBlocks && len(msg) < batchMaxSize; {
+		select {
+		case frame := <-frames:
+			if comp != nil {
+				frame = comp.compress(frame)
+			}
+			msg = appendItem(msg, frame)
+			numBlock++
+		default:
+			more = false
+		}
+	}
+	binary.BigEndian.PutUint32(msg, uint32(numBlock))
+	return msg
+}
+
+// frameMaxBlockSize is the max size of an ethernet frame carried in a block,
+// same as MAX_PACKET_SIZE of SoftEtherVPN
+const frameMaxBlockSize = 1600
+
+// Limits of a message of the stream
+const (
+	frameMaxBlocks   = 0xfff // more is not a number of blocks
+	keepAliveMaxSize = 512   // MAX_KEEPALIVE_SIZE of SoftEtherVPN
+)
+
+// blockReader reads messages in the data format above from the tunnel.
+// TLS records split and join messages freely, so a message is read by its
+// sizes instead of one conn.Read.
+type blockReader struct {
+	rd  *bufio.Reader
+	hdr [4]byte
+	buf [compressedMaxBlockSize]byte
+	// blocks are decompressed by it unless nil
+	decomp *frameDecompressor
+}
+
+func newBlockReader(rd *bufio.Reader) *blockReader {
+	return &blockReader{rd: rd}
+}
+
+func (b *blockReader) readUint32() (uint32, error) {
+	if _, err := io.ReadFull(b.rd, b.hdr[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b.hdr[:]), nil
+}
+
+// readMsg reads the next message and calls onFrame for every block of it,
+// a keep-alive has none. The frame is only valid until onFrame returns.
+// An error means the stream is broken or closed.
+func (b *blockReader) readMsg(onFrame func(frame []byte) error) error {
+	numBlock, err := b.readUint32()
+	if err != nil {
+		return err
+	}
+	if numBlock == KeepAliveMsg {
+		// its data is random padding
+		size, err := b.readUint32()
+		if err != nil {
+			return err
+		}
+		if size > keepAliveMaxSize {
+			return fmt.Errorf("keep-alive of size %d", size)
+		}
+		_, err = b.rd.Discard(int(size))
+		return err
+	}
+	if numBlock > frameMaxBlocks {
+		return fmt.Errorf("bad number of blocks %x", numBlock)
+	}
+	maxSize := uint32(frameMaxBlockSize)
+	if b.decomp != nil {
+		maxSize = compressedMaxBlockSize
+	}
+	for i := uint32(0); i < numBlock; i++ {
+		sizeBlock, err := b.readUint32()
+		if err != nil {
+			return err
+		}
+		if sizeBlock > maxSize {
+			return fmt.Errorf("block %d of %d has size %d", i, numBlock, sizeBlock)
+		}
+		frame := b.buf[:sizeBlock]
+		if _, err = io.ReadFull(b.rd, frame); err != nil {
+			return err
+		}
+		if b.decomp != nil {
+			if frame, err = b.decomp.decompress(frame); err != nil {
+				return err
+			}
+		}
+		if err = onFrame(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package softether
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// testHello and testWelcome are packs as a SoftEtherVPN server sends them
+var (
+	testHello = serverHello{
+		Hello:   "SoftEther VPN Server Developer Edition",
+		Version: 438,
+		Build:   9760,
+		Random:  bytes.Repeat([]byte{0x5a}, sha0Size),
+	}
+	testWelcome = welcome{
+		SessionName:           "SID-ME-[VPN]-1",
+		ConnectionName:        "CID-2",
+		SessionKey:            bytes.Repeat([]byte{0xa5}, sha0Size),
+		MaxConnection:         8,
+		UseEncrypt:            true,
+		UseCompress:           true,
+		Timeout:               20000,
+		Ports:                 []uint32{443, 992},
+		UseUDPAccel:           true,
+		UDPAccelVersion:       1,
+		UDPAccelServerPort:    40000,
+		UDPAccelServerKey:     bytes.Repeat([]byte{0x3c}, 20),
+		UDPAccelServerCookie:  7,
+		UDPAccelClientCookie:  8,
+		UDPAccelUseEncryption: true,
+	}
+)
+
+// seedPacks returns the bodies of testHello and testWelcome
+func seedPacks(tb testing.TB) [][]byte {
+	var bodies [][]byte
+	for _, v := range []interface{}{testHello, testWelcome} {
+		body, err := marshalPack(v)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		bodies = append(bodies, body)
+	}
+	return bodies
+}
+
+// packRoundTrips are elems of every type with none, one and many items, as
+// parseData returns them
+var packRoundTrips = []struct {
+	name  string
+	value interface{}
+}{
+	{"int0", []uint32{}},
+	{"int1", uint32(7)},
+	{"intN", []uint32{0, 1, 0xffffffff}},
+	{"int64_0", []uint64{}},
+	{"int64_1", uint64(1 << 40)},
+	{"int64_N", []uint64{0, 1, 0xffffffffffffffff}},
+	{"data0", [][]byte{}},
+	{"data1", []byte{1, 2, 3}},
+	{"dataN", [][]byte{{}, {0}, bytes.Repeat([]byte{0xaa}, 300)}},
+	{"str0", []string{}},
+	{"str1", "hello"},
+	{"strN", []string{"", "a", "hub\\user"}},
+	{"unistr0", []uniStr{}},
+	{"unistr1", uniStr("héllo")},
+	{"unistrN", []uniStr{"", "x", "日本語"}},
+}
+
+func TestPackRoundTrip(t *testing.T) {
+	for _, tt := range packRoundTrips {
+		body, err := addData(nil, map[string]interface{}{tt.name: tt.value})
+		if err != nil {
+			t.Fatalf("%s: addData: %v", tt.name, err)
+		}
+		m, err := parseData(body)
+		if err != nil {
+			t.Fatalf("%s: parseData: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(m[tt.name], tt.value) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, m[tt.name], tt.value)
+		}
+	}
+
+	// all of them in one pack, written the same again
+	all := map[string]interface{}{}
+	for _, tt := range packRoundTrips {
+		all[tt.name] = tt.value
+	}
+	body, err := addData(nil, all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseData(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, all) {
+		t.Errorf("got %#v, want %#v", m, all)
+	}
+	again, err := addData(nil, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, body) {
+		t.Errorf("written again as %x, want %x", again, body)
+	}
+}
+
+// Go types written as the elem types parseData returns
+func TestPackAddTypes(t *testing.T) {
+	tests := []struct {
+		value, want interface{}
+	}{
+		{int(5), uint32(5)},
+		{int32(-1), uint32(0xffffffff)},
+		{uint(5), uint32(5)},
+		{[]int{1, 2}, []uint32{1, 2}},
+		{int64(-1), uint64(0xffffffffffffffff)},
+		{[]int64{1, 2}, []uint64{1, 2}},
+	}
+	for _, tt := range tests {
+		body, err := addData(nil, map[string]interface{}{"v": tt.value})
+		if err != nil {
+			t.Fatalf("%T: %v", tt.value, err)
+		}
+		m, err := parseData(body)
+		if err != nil {
+			t.Fatalf("%T: %v", tt.value, err)
+		}
+		if !reflect.DeepEqual(m["v"], tt.want) {
+			t.Errorf("%T: got %#v, want %#v", tt.value, m["v"], tt.want)
+		}
+	}
+	if _, err := addData(nil, map[string]interface{}{"v": 1.5}); err == nil {
+		t.Error("float64 written")
+	}
+}
+
+// FuzzParseData checks that parseData never fails badly on what a server may
+// send, and that what it returns is written back the same way
+func FuzzParseData(f *testing.F) {
+	for _, body := range seedPacks(f) {
+		f.Add(body)
+	}
+	f.Fuzz(func(t *testing.T, body []byte) {
+		m, err := parseData(body)
+		if err != nil {
+			return
+		}
+		again, err := addData(nil, m)
+		if err != nil {
+			t.Fatalf("addData of %#v: %v", m, err)
+		}
+		m2, err := parseData(again)
+		if err != nil {
+			t.Fatalf("parseData of %x: %v", again, err)
+		}
+		if !reflect.DeepEqual(m, m2) {
+			t.Fatalf("got %#v, want %#v", m2, m)
+		}
+	})
+}
+
+// FuzzParseHttpResponse reads a response of the server, whose Content-Length
+// must not be trusted
+func FuzzParseHttpResponse(f *testing.F) {
+	for _, body := range seedPacks(f) {
+		f.Add([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\n"+
+			"Content-Length: %d\r\nConnection: Keep-Alive\r\n\r\n%s", len(body), body)))
+	}
+	f.Add([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		body, err := parseHttpResponse(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return
+		}
+		if len(body) > packMaxSize || len(body) > len(data) {
+			t.Fatalf("body of %d bytes from %d", len(body), len(data))
+		}
+	})
+}
+
+// FuzzReadMsg reads messages of the data format, compressed or not, until
+// the stream is broken
+func FuzzReadMsg(f *testing.F) {
+	bodies := seedPacks(f)
+	frames := make(chan []byte, len(bodies))
+	for _, body := range bodies[1:] {
+		frames <- body
+	}
+	comp := newFrameCompressor(&compressStats{})
+	f.Add(framePack(1, len(bodies[0]), bodies[0]), false)
+	f.Add(batchFrames(bodies[0], frames, nil), false)
+	f.Add(append(keepAlivePack(), framePack(0, 0, nil)[:4]...), false)
+	f.Add(batchFrames(bodies[0], nil, comp), true)
+	f.Fuzz(func(t *testing.T, data []byte, compressed bool) {
+		br := newBlockReader(bufio.NewReader(bytes.NewReader(data)))
+		if compressed {
+			br.decomp = newFrameDecompressor(&compressStats{})
+		}
+		onFrame := func(frame []byte) error {
+			if len(frame) > frameMaxBlockSize {
+				t.Fatalf("frame of %d bytes", len(frame))
+			}
+			return nil
+		}
+		for br.readMsg(onFrame) == nil {
+		}
+	})
+}
+
+// BenchmarkBatchFrames writes frames of bulk traffic over TLS on the loopback
+// interface, one message each or batched as the tunnel does
+func BenchmarkBatchFrames(b *testing.B) {
+	b.Run("PerFrame", func(b *testing.B) { benchmarkFrames(b, false) })
+	b.Run("Batched", func(b *testing.B) { benchmarkFrames(b, true) })
+}
+
+func benchmarkFrames(b *testing.B, batched bool) {
+	cert, _ := testCert(b)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan int, 1)
+	go func() {
+		n := 0
+		defer func() { received <- n }()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := newBlockReader(bufio.NewReader(conn))
+		for br.readMsg(func([]byte) error { n++; return nil }) == nil {
+		}
+	}()
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	frame := make([]byte, 1400)
+	frames := make(chan []byte, frameQueueLen)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			frames <- frame
+		}
+	}()
+	b.SetBytes(int64(len(frame)))
+	b.ResetTimer()
+	for sent := 0; sent < b.N; {
+		first := <-frames
+		var msg []byte
+		if batched {
+			msg = batchFrames(first, frames, nil)
+			sent += int(binary.BigEndian.Uint32(msg))
+		} else {
+			msg = framePack(1, len(first), first)
+			sent++
+		}
+		if _, err := conn.Write(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+	conn.Close()
+	if n := <-received; n != b.N {
+		b.Fatalf("%d frames received of %d", n, b.N)
+	}
+}
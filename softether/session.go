@@ -0,0 +1,186 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package softether
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backoff of reconnect attempts after the tunnel is lost
+const (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = time.Minute
+)
+
+// Keep-alive of a session, when neither the user nor the server sets them
+const (
+	DefaultKeepAlive        = 10 * time.Second
+	defaultKeepAliveTimeout = 30 * time.Second
+)
+
+// Session is a session logged in to the server and its connections
+type Session struct {
+	// hostport logged in, a member server if the cluster redirected
+	server string
+	// of the server certificate, connections are pinned to it
+	fingerprint string
+	wel         welcome
+	conns       []*tunnelConn
+	udp         *udpChannel
+	compress    *compressStats
+
+	// closed when a connection is lost
+	lost     chan struct{}
+	lostOnce sync.Once
+	// time of the last message read, in UnixNano, atomic
+	lastRecv int64
+	// goroutines of the connections, set by run
+	wg *sync.WaitGroup
+}
+
+// setup sets the connections up by what the server agreed in wel
+func (s *Session) setup() error {
+	if s.wel.UseCompress && s.compress == nil {
+		s.compress = &compressStats{}
+	}
+	for _, t := range s.conns {
+		t.compress = s.compress
+	}
+	if up, down := s.directions(); s.wel.HalfConnection && (up == 0 || down == 0) {
+		// nothing would be sent or received
+		return errors.New("half connection without connection of both directions")
+	}
+	s.lost = make(chan struct{})
+	s.received()
+	return nil
+}
+
+// run starts moving frames over the connections, see tunnelConn.run, their
+// goroutines are added to wg
+func (s *Session) run(dev io.Writer, chanWrite chan []byte, wg *sync.WaitGroup) {
+	s.wg = wg
+	for _, t := range s.conns {
+		t.run(dev, chanWrite, s)
+	}
+}
+
+// received tells the session a message was read, frames or keep-alive
+func (s *Session) received() {
+	atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+}
+
+// idle is the time since the last message read
+func (s *Session) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.lastRecv)))
+}
+
+// keepAlive returns the interval of keep-alive and the timeout after which
+// the session is lost if nothing is read, as set or else by the server.
+// The server drops the session after its timeout too, so keep-alive is
+// sent twice in it at least.
+func (s *Session) keepAlive(interval, timeout time.Duration) (time.Duration, time.Duration) {
+	server := time.Duration(s.wel.Timeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = server
+	}
+	if timeout == 0 {
+		timeout = defaultKeepAliveTimeout
+	}
+	if interval == 0 {
+		interval = DefaultKeepAlive
+	}
+	if server != 0 && interval > server/2 {
+		interval = server / 2
+	}
+	return interval, timeout
+}
+
+// lose tells the session a connection is lost, by err
+func (s *Session) lose(err error) {
+	s.lostOnce.Do(func() {
+		Debug("tunnel lost: %v\n", err)
+		close(s.lost)
+	})
+}
+
+// closeConns closes the connections, which makes their goroutines quit
+func (s *Session) closeConns() {
+	for _, t := range s.conns {
+		t.close()
+	}
+}
+
+// Close closes s, which is not served, Serve closes it otherwise
+func (s *Session) Close() {
+	s.close()
+}
+
+// close closes the connections and the UDP channel
+func (s *Session) close() {
+	s.closeConns()
+	if s.udp != nil {
+		s.udp.close()
+	}
+}
+
+// directions counts connections sending only and receiving only
+func (s *Session) directions() (up, down int) {
+	for _, t := range s.conns {
+		switch t.direction {
+		case tcpClientToServer:
+			up++
+		case tcpServerToClient:
+			down++
+		}
+	}
+	return up, down
+}
+
+// Server is the host:port logged in to, a member server if the cluster
+// redirected
+func (s *Session) Server() string {
+	return s.server
+}
+
+// Conns is the number of TCP connections of s
+func (s *Session) Conns() int {
+	return len(s.conns)
+}
+
+// Directions counts connections uploading only and downloading only, both
+// are 0 unless s is a half connection session
+func (s *Session) Directions() (up, down int) {
+	return s.directions()
+}
+
+// UDPReady tells if frames go over UDP acceleration now
+func (s *Session) UDPReady() bool {
+	return s.udp.ready()
+}
+
+// CompressRatio is raw bytes per compressed byte of frames so far, ok is
+// false if s is not compressed
+func (s *Session) CompressRatio() (ratio float64, ok bool) {
+	if s.compress == nil {
+		return 0, false
+	}
+	return s.compress.ratio(), true
+}
+
+// reconnectDelay is the backoff before reconnect attempt, starting at 1, as
+// twice the one before up to reconnectMaxDelay. It is randomized, so that
+// clients lost at the same time don't reconnect at the same time.
+func reconnectDelay(attempt int) time.Duration {
+	delay := reconnectMaxDelay
+	if attempt < 7 {
+		delay = reconnectMinDelay << uint(attempt-1)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
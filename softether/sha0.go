@@ -0,0 +1,62 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package softether
+
+import "encoding/binary"
+
+// SoftEtherVPN hashes passwords with SHA-0, the withdrawn first version of
+// SHA-1, which go doesn't provide. It differs from SHA-1 only by the missing
+// rotation when expanding the message schedule.
+
+const sha0Size = 20
+
+func sha0Sum(data []byte) [sha0Size]byte {
+	h := [5]uint32{0x67452301, 0xEFCDAB89, 0x98BADCFE, 0x10325476, 0xC3D2E1F0}
+
+	// padding: 0x80, zeros, then length in bits, to a multiple of 64 bytes
+	msg := append([]byte{}, data...)
+	msg = append(msg, 0x80)
+	for len(msg)%64 != 56 {
+		msg = append(msg, 0)
+	}
+	msg = appendUint64(msg, uint64(len(data))*8)
+
+	var w [80]uint32
+	for ; len(msg) > 0; msg = msg[64:] {
+		for i := 0; i < 16; i++ {
+			w[i] = binary.BigEndian.Uint32(msg[i*4:])
+		}
+		for i := 16; i < 80; i++ {
+			w[i] = w[i-3] ^ w[i-8] ^ w[i-14] ^ w[i-16]
+		}
+		a, b, c, d, e := h[0], h[1], h[2], h[3], h[4]
+		for i := 0; i < 80; i++ {
+			var f, k uint32
+			switch {
+			case i < 20:
+				f, k = b&c|^b&d, 0x5A827999
+			case i < 40:
+				f, k = b^c^d, 0x6ED9EBA1
+			case i < 60:
+				f, k = b&c|b&d|c&d, 0x8F1BBCDC
+			default:
+				f, k = b^c^d, 0xCA62C1D6
+			}
+			t := (a<<5 | a>>27) + f + e + k + w[i]
+			a, b, c, d, e = t, a, b<<30|b>>2, c, d
+		}
+		h[0] += a
+		h[1] += b
+		h[2] += c
+		h[3] += d
+		h[4] += e
+	}
+
+	var sum [sha0Size]byte
+	for i, v := range h {
+		binary.BigEndian.PutUint32(sum[i*4:], v)
+	}
+	return sum
+}
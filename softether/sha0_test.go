@@ -0,0 +1,65 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package softether
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// TestSHA0 checks sha0Sum against the examples of FIPS 180, one block, two
+// blocks and many, and the empty message
+func TestSHA0(t *testing.T) {
+	tests := []struct {
+		data, want string
+	}{
+		{"abc", "0164b8a914cd2a5e74c4f7ff082c4d97f1edf880"},
+		{"abcdbcdecdefdefgefghfghighijhijkijkljklmklmnlmnomnopnopq", "d2516ee1acfa5baf33dfc1c471e438449ef134c8"},
+		{strings.Repeat("a", 1000000), "3232affa48628a26653b5aaa44541fd90d690603"},
+		{"", "f96cea198ad1dd5617ac084a3d92c6107708c0ef"},
+	}
+	for _, tt := range tests {
+		sum := sha0Sum([]byte(tt.data))
+		if got := hex.EncodeToString(sum[:]); got != tt.want {
+			t.Errorf("SHA-0 of %.10q: %s, want %s", tt.data, got, tt.want)
+		}
+	}
+}
+
+// TestHashPassword checks the password hash as HashedPassword of an account
+// keeps it, and as it is sent mixed with the random of the server
+func TestHashPassword(t *testing.T) {
+	tests := []struct {
+		usr, passwd, want string
+	}{
+		{"vpn", "vpn", "H8N7rT8BH44q0nFXC9NlFxetGzQ="},
+		{"me", "secret", "0SDhq47c2JRlDBOI8bjQn9yfRLg="},
+		{"ME", "secret", "0SDhq47c2JRlDBOI8bjQn9yfRLg="},
+		// only ASCII letters are upper cased
+		{"josé", "pässword", "o+x8nD95ZNsy/RK/uSAcZLXnpmo="},
+	}
+	for _, tt := range tests {
+		if got := base64.StdEncoding.EncodeToString(hashPassword(tt.usr, tt.passwd)); got != tt.want {
+			t.Errorf("hash of %s, %s: %s, want %s", tt.usr, tt.passwd, got, tt.want)
+		}
+	}
+
+	random := make([]byte, sha0Size)
+	for i := range random {
+		random[i] = byte(i)
+	}
+	secure, err := securePassword(hashPassword("vpn", "vpn"), random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hex.EncodeToString(secure), "09aabdcf0bd28b416c19a219e71230aa132027c3"; got != want {
+		t.Errorf("secure password %s, want %s", got, want)
+	}
+	if _, err := securePassword(random[:10], random); err == nil {
+		t.Error("hash of 10 bytes taken")
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package softether
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Trust decides if the certificate of a server is trusted:
+//  1. Pins set: only a certificate of a pinned SHA-256 fingerprint
+//  2. the fingerprint Known, which was trusted on first use before
+//  3. a chain to CAFile, or to the system roots if CAFile is empty,
+//     and the name of the server matching
+//
+// Note no Debug here, it may be the log server being verified.
+type Trust struct {
+	CAFile string
+	Pins   []string
+	Known  string
+}
+
+// UntrustedCert is the error of a server certificate not trusted, with what
+// the user needs to decide to trust it or not. The handshake of a config of
+// TLSConfig fails with it.
+type UntrustedCert struct {
+	Cert        *x509.Certificate
+	Fingerprint string
+	Reason      error
+	// Pinned is set when it doesn't match a configured pin, so the user
+	// can't choose to trust it, Changed when it is not the known one
+	Pinned  bool
+	Changed bool
+	// HostPort of the server, set by Client
+	HostPort string
+}
+
+func (u *UntrustedCert) Error() string {
+	return fmt.Sprintf("server certificate %s not trusted: %v", u.Fingerprint, u.Reason)
+}
+
+// CertFingerprint is the SHA-256 of cert in upper case hex, joined by ':'
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	s := strings.ToUpper(hex.EncodeToString(sum[:]))
+	var parts []string
+	for i := 0; i < len(s); i += 2 {
+		parts = append(parts, s[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
+
+// SameFingerprint compares fingerprints ignoring case and separators
+func SameFingerprint(a, b string) bool {
+	norm := func(s string) string {
+		s = strings.Replace(s, ":", "", -1)
+		s = strings.Replace(s, " ", "", -1)
+		return strings.ToLower(s)
+	}
+	return a != "" && norm(a) == norm(b)
+}
+
+// TLSConfig returns the config to dial serverName with. Verification is done
+// by the callback instead of crypto/tls, so that pins and the known
+// fingerprint work for self-signed certificates as SoftEtherVPN uses.
+func (t *Trust) TLSConfig(serverName string) (*tls.Config, error) {
+	var roots *x509.CertPool
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificate", t.CAFile)
+		}
+	}
+
+	verify := func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("server sent no certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = cert
+		}
+		u := &UntrustedCert{Cert: certs[0], Fingerprint: CertFingerprint(certs[0])}
+
+		if len(t.Pins) > 0 {
+			for _, pin := range t.Pins {
+				if SameFingerprint(pin, u.Fingerprint) {
+					return nil
+				}
+			}
+			u.Pinned = true
+			u.Reason = errors.New("not a pinned fingerprint")
+			return u
+		}
+		if SameFingerprint(t.Known, u.Fingerprint) {
+			return nil
+		}
+
+		opts := x509.VerifyOptions{
+			DNSName:       serverName,
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(opts)
+		if err == nil {
+			return nil
+		}
+		u.Reason = err
+		u.Changed = t.Known != ""
+		return u
+	}
+
+	return &tls.Config{
+		ServerName:            serverName,
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verify,
+	}, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package softether
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"testing"
+)
+
+// TestTrust checks that a handshake fails with the UntrustedCert of what
+// the certificate is not trusted by, also when dialing at the same time
+func TestTrust(t *testing.T) {
+	cert, fingerprint := testCert(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	tests := []struct {
+		name    string
+		trust   Trust
+		ok      bool
+		pinned  bool
+		changed bool
+	}{
+		{"self-signed", Trust{}, false, false, false},
+		{"known", Trust{Known: fingerprint}, true, false, false},
+		{"pinned", Trust{Pins: []string{"AB:CD", fingerprint}}, true, false, false},
+		{"not pinned", Trust{Pins: []string{"AB:CD"}, Known: fingerprint}, false, true, false},
+		{"changed", Trust{Known: "AB:CD"}, false, false, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		// each Trust is shared by dials at the same time
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				config, err := tt.trust.TLSConfig("127.0.0.1")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				conn, err := tls.Dial("tcp", ln.Addr().String(), config)
+				if err == nil {
+					conn.Close()
+				}
+				if tt.ok {
+					if err != nil {
+						t.Errorf("%s: %v", tt.name, err)
+					}
+					return
+				}
+				u, ok := err.(*UntrustedCert)
+				if !ok {
+					t.Errorf("%s: %v, not an UntrustedCert", tt.name, err)
+					return
+				}
+				if u.Fingerprint != fingerprint || u.Pinned != tt.pinned || u.Changed != tt.changed {
+					t.Errorf("%s: %+v", tt.name, u)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// TestConnectUntrusted checks that Connect fails with the UntrustedCert of
+// the server
+func TestConnectUntrusted(t *testing.T) {
+	f, cfg := startFakeServer(t)
+	defer f.close()
+	fingerprint := cfg.Pins[0]
+	cfg.Pins = nil
+	_, err := (&Client{Config: cfg}).Connect(context.Background())
+	u, ok := err.(*UntrustedCert)
+	if !ok {
+		t.Fatalf("%v, not an UntrustedCert", err)
+	}
+	if u.Fingerprint != fingerprint || u.HostPort != cfg.Host {
+		t.Errorf("%+v", u)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package softether
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// MaxConnections is the most TCP connections of a session SoftEtherVPN allows
+const MaxConnections = 32
+
+// run moves frames of the session over t until t is closed: frames queued in
+// chanWrite are written in batches, frames read are written to dev.
+// When a session has several connections, each takes frames from the same
+// chanWrite whenever it is free to write, and the server merges them.
+// For a half connection session t only writes or only reads frames by its
+// direction, but keep-alives are written on every connection for the server
+// to keep them. s is told when t reads a message, or fails to write or read.
+func (t *tunnelConn) run(dev io.Writer, chanWrite chan []byte, s *Session) {
+	t.done = make(chan struct{})
+	// keep-alive messages are sent as they are
+	t.ctrl = make(chan []byte, 1)
+	if t.direction == tcpServerToClient {
+		// no frames to take
+		chanWrite = nil
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t.writeLoop(chanWrite, s.lose)
+	}()
+	if t.direction != tcpClientToServer {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			t.readLoop(dev, s)
+		}()
+	}
+}
+
+// writeLoop waits on chanWrite, nil for control messages only, and writes
+// packets to SSL tunnel
+func (t *tunnelConn) writeLoop(chanWrite chan []byte, lost func(error)) {
+	var comp *frameCompressor
+	if t.compress != nil {
+		comp = newFrameCompressor(t.compress)
+	}
+	for {
+		var msg []byte
+		select {
+		case frame := <-chanWrite:
+			msg = batchFrames(frame, chanWrite, comp)
+		case msg = <-t.ctrl:
+		case <-t.done:
+			// not to take frames of connections after it
+			return
+		}
+		//Debug("Write to tunnel:\n% x\n", msg)
+		_, err := t.conn.Write(msg)
+		if err != nil {
+			Debug("conn is closed for write, quit\n")
+			lost(err)
+			return
+		}
+
+	}
+}
+
+// readLoop reads from SSL tunnel and writes frames to dev
+func (t *tunnelConn) readLoop(dev io.Writer, s *Session) {
+	br := newBlockReader(t.rd)
+	if t.compress != nil {
+		br.decomp = newFrameDecompressor(t.compress)
+	}
+	for {
+		err := br.readMsg(func(frame []byte) error {
+			//This parse is for debug only
+			//pktParse(frame)
+			// write thru TAP interface
+			_, err := dev.Write(frame)
+			return err
+		})
+		if err != nil {
+			Debug("conn or iface is closed, quit: %v\n", err)
+			s.lose(err)
+			return
+		}
+		s.received()
+	}
+}
+
+// close closes t, which makes its goroutines quit
+func (t *tunnelConn) close() {
+	t.closeOnce.Do(func() {
+		t.conn.Close()
+		t.handshakeDone()
+		if t.done != nil {
+			close(t.done)
+		}
+	})
+}
+
+// sendCtrl queues a control message like keep-alive, it is dropped if one
+// is still waiting, the next one will do
+func (t *tunnelConn) sendCtrl(msg []byte) {
+	select {
+	case t.ctrl <- msg:
+	default:
+	}
+}
+
+// additionalConnect opens one more connection to the session logged in with
+// wel, on hostport which is verified by trust
+func additionalConnect(ctx context.Context, hostport string, trust *Trust, wel *welcome) (*tunnelConn, error) {
+	t, err := dialServer(ctx, hostport, trust)
+	if err != nil {
+		return nil, err
+	}
+	req := additionalConnectRequest{
+		Method:      "additional_connect",
+		SessionKey:  wel.SessionKey,
+		ClientStr:   t.hello.Hello,
+		ClientVer:   t.hello.Version,
+		ClientBuild: t.hello.Build,
+	}
+	var reply additionalConnectReply
+	err = t.postPack(&req, &reply)
+	if err == nil && reply.Error != 0 {
+		err = LoginError(reply.Error)
+	}
+	if err != nil {
+		t.close()
+		return nil, ctxErr(ctx, err)
+	}
+	t.handshakeDone()
+	t.direction = reply.Direction
+	return t, nil
+}
+
+// addConnections opens up to n more connections to the session at the same
+// time, those failed are left out. They must present the certificate of
+// fingerprint, which the first connection was verified with.
+func addConnections(ctx context.Context, hostport, fingerprint string, wel *welcome, n int) []*tunnelConn {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var conns []*tunnelConn
+	trust := &Trust{Pins: []string{fingerprint}}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t, err := additionalConnect(ctx, hostport, trust, wel)
+			if err != nil {
+				Debug("additional connection failed: %v\n", err)
+				return
+			}
+			mu.Lock()
+			conns = append(conns, t)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return conns
+}
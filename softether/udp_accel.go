@@ -0,0 +1,146 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package softether
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"gosec/udpaccel"
+)
+
+// udpChannel is the UDP acceleration of a session: frames go over UDP while
+// it works both ways, over the TLS connections otherwise
+type udpChannel struct {
+	conn  *net.UDPConn
+	key   []byte
+	accel *udpaccel.Accel
+	// closed by close
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newUDPChannel opens the UDP port to offer in the login
+func newUDPChannel() (*udpChannel, error) {
+	key, err := udpaccel.NewKey()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	return &udpChannel{conn: conn, key: key, done: make(chan struct{})}, nil
+}
+
+// addToLogin offers UDP acceleration in login, the TLS connection is from
+// local
+func (u *udpChannel) addToLogin(login *loginRequest, local net.Addr) {
+	login.UseUDPAccel = true
+	login.UDPAccelVersion = udpaccel.Version
+	if addr, ok := local.(*net.TCPAddr); ok {
+		login.UDPAccelClientIP = packIP(addr.IP)
+	}
+	login.UDPAccelClientPort = uint32(u.conn.LocalAddr().(*net.UDPAddr).Port)
+	login.UDPAccelClientKey = u.key
+}
+
+// start starts the channel to the server agreed in wel, which is server if
+// wel has no IP. Frames are received after run.
+func (u *udpChannel) start(wel *welcome, server net.Addr) error {
+	if !wel.UseUDPAccel || wel.UDPAccelVersion != udpaccel.Version || wel.UDPAccelServerPort == 0 {
+		return errors.New("UDP acceleration not accepted")
+	}
+	host, _, err := net.SplitHostPort(server.String())
+	if err != nil {
+		return err
+	}
+	if wel.UDPAccelServerIP != 0 {
+		host = unpackIP(wel.UDPAccelServerIP).String()
+	}
+	peer, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(host, strconv.Itoa(int(wel.UDPAccelServerPort))))
+	if err != nil {
+		return err
+	}
+	u.accel, err = udpaccel.New(u.conn, peer, udpaccel.Params{
+		MyKey:      u.key,
+		YourKey:    wel.UDPAccelServerKey,
+		MyCookie:   wel.UDPAccelClientCookie,
+		YourCookie: wel.UDPAccelServerCookie,
+		Plain:      !wel.UDPAccelUseEncryption,
+	})
+	if err != nil {
+		return err
+	}
+	Debug("UDP acceleration with %v\n", peer)
+	return nil
+}
+
+// run keeps u alive and writes frames received to dev until u is closed,
+// the goroutines are added to wg
+func (u *udpChannel) run(dev io.Writer, wg *sync.WaitGroup) {
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for u.accel.KeepAlive() == nil {
+			select {
+			case <-u.done:
+				return
+			case <-time.After(udpaccel.NextKeepAlive()):
+			}
+		}
+		Debug("UDP is closed for write, quit\n")
+	}()
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, udpaccel.MaxPacketSize)
+		for {
+			frame, err := u.accel.Recv(buf)
+			if err == nil {
+				_, err = dev.Write(frame)
+			}
+			if err != nil {
+				Debug("UDP or iface is closed, quit: %v\n", err)
+				return
+			}
+		}
+	}()
+}
+
+// ready tells if frames go over UDP now
+func (u *udpChannel) ready() bool {
+	return u != nil && u.accel != nil && u.accel.Ready()
+}
+
+// send sends frame over UDP if it works, false if it is to be sent over TLS
+func (u *udpChannel) send(frame []byte) bool {
+	return u.ready() && u.accel.Send(frame) == nil
+}
+
+func (u *udpChannel) close() {
+	u.closeOnce.Do(func() {
+		u.conn.Close()
+		close(u.done)
+	})
+}
+
+// packIP is ip as an int of pack, which SoftEtherVPN adds from memory, so it
+// is in little endian
+func packIP(ip net.IP) uint32 {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0
+	}
+	return uint32(ip4[0]) | uint32(ip4[1])<<8 | uint32(ip4[2])<<16 | uint32(ip4[3])<<24
+}
+
+// unpackIP is the reverse of packIP
+func unpackIP(v uint32) net.IP {
+	return net.IPv4(byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
@@ -0,0 +1,541 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"gosec/softether"
+)
+
+// The text UI draws the form of uiFn with ANSI escapes in the terminal put
+// in raw mode, so it works over SSH without X11. It is redrawn on every key,
+// state change and second, for the traffic panel.
+
+const (
+	ansiClear   = "\x1b[H\x1b[2J"
+	ansiAltOn   = "\x1b[?1049h\x1b[?25l" // alternate screen, no cursor
+	ansiAltOff  = "\x1b[?25h\x1b[?1049l"
+	ansiReverse = "\x1b[7m"
+	ansiBold    = "\x1b[1m"
+	ansiRed     = "\x1b[31m"
+	ansiGreen   = "\x1b[32m"
+	ansiYellow  = "\x1b[33m"
+	ansiReset   = "\x1b[0m"
+)
+
+// keys read from the terminal, runes typed are keyRune
+const (
+	keyRune = iota
+	keyUp
+	keyDown
+	keyLeft
+	keyRight
+	keyTab
+	keyBackTab
+	keyEnter
+	keyBackspace
+	keyClear // Ctrl-U
+	keyQuit  // Ctrl-C, Ctrl-Q
+	keySave  // Ctrl-S
+)
+
+type tuiKey struct {
+	code int
+	r    rune
+}
+
+// kinds of fields of the form
+const (
+	fieldText = iota
+	fieldCheck
+	fieldAuth
+	fieldConns
+	fieldButton
+	fieldProfile
+)
+
+type tuiField struct {
+	kind  int
+	label string
+	text  *string // fieldText
+	mask  bool
+	check *bool // fieldCheck
+}
+
+// tui is the state of the text UI besides c
+type tui struct {
+	c   *vpnSetting
+	cur int
+	// shown until the next key
+	msg string
+	// certificate asked to trust
+	trust *softether.UntrustedCert
+
+	// traffic of the last second, for rates
+	stats    *trafficStats
+	last     trafficStats
+	lastTime time.Time
+	rates    [2]float64 // sent, received bytes per second
+}
+
+// runTUI runs the text UI until the user quits, disconnecting first
+func (c *vpnSetting) runTUI() error {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return errors.New("-tui needs a terminal")
+	}
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer terminal.Restore(fd, state)
+	// debug printed would garble the screen
+	debugAway(configPath("debug.log"))
+	fmt.Print(ansiAltOn)
+	defer fmt.Print(ansiAltOff)
+
+	redraw := make(chan struct{}, 1)
+	c.onChange = func() {
+		select {
+		case redraw <- struct{}{}:
+		default:
+		}
+	}
+	keys := make(chan tuiKey, 16)
+	go readKeys(os.Stdin, keys)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	t := &tui{c: c, lastTime: time.Now()}
+	for {
+		c.applySecrets()
+		if c.connState == nConnected {
+			c.forgetPasswd()
+		}
+		t.draw()
+		select {
+		case k, ok := <-keys:
+			if !ok || k.code == keyQuit {
+				if c.cancel != nil {
+					c.cancel()
+				}
+				if c.done != nil {
+					fmt.Print(ansiClear + "Disconnecting ...\r\n")
+					<-c.done
+				}
+				return nil
+			}
+			t.msg = ""
+			t.key(k)
+		case <-redraw:
+		case <-ticker.C:
+			t.tick()
+		}
+	}
+}
+
+// fields are the fields of the form, as uiFn shows them
+func (t *tui) fields() []tuiField {
+	c := t.c
+	fields := []tuiField{
+		{kind: fieldProfile, label: "Profile"},
+		{kind: fieldText, label: "HostName", text: &c.host},
+		{kind: fieldText, label: "HubName", text: &c.hub},
+		{kind: fieldText, label: "UserName", text: &c.usr},
+		{kind: fieldCheck, label: "Anonymous", check: &c.anonymous},
+	}
+	if !c.anonymous {
+		label := "Password"
+		if c.authType == softether.AuthCert {
+			label = "Passphrase"
+		}
+		fields = append(fields,
+			tuiField{kind: fieldText, label: label, text: &c.passwd, mask: true},
+			tuiField{kind: fieldAuth, label: "Auth"})
+		if c.authType == softether.AuthCert {
+			fields = append(fields,
+				tuiField{kind: fieldText, label: "Cert file", text: &c.certFile},
+				tuiField{kind: fieldText, label: "Key file", text: &c.keyFile})
+		}
+	}
+	return append(fields,
+		tuiField{kind: fieldConns, label: "Connections"},
+		tuiField{kind: fieldCheck, label: "Half-duplex", check: &c.halfConn},
+		tuiField{kind: fieldCheck, label: "Compress", check: &c.compress},
+		tuiField{kind: fieldCheck, label: "UDP accel", check: &c.udpAccel},
+		tuiField{kind: fieldButton})
+}
+
+// key handles k on the current field, or the trust question
+func (t *tui) key(k tuiKey) {
+	c := t.c
+	if u := t.trust; u != nil {
+		switch {
+		case k.code == keyRune && (k.r == 'y' || k.r == 'Y'):
+			if err := saveKnownServer(u.HostPort, u.Fingerprint); err != nil {
+				Debug("err: %v\n", err)
+			}
+			t.trust = nil
+			c.err = eNone
+			c.connect()
+		case k.code == keyRune && (k.r == 'n' || k.r == 'N'), k.code == keyEnter:
+			t.trust = nil
+		}
+		return
+	}
+
+	fields := t.fields()
+	if t.cur >= len(fields) {
+		t.cur = len(fields) - 1
+	}
+	f := fields[t.cur]
+	switch k.code {
+	case keyTab, keyDown:
+		t.cur = (t.cur + 1) % len(fields)
+		return
+	case keyBackTab, keyUp:
+		t.cur = (t.cur + len(fields) - 1) % len(fields)
+		return
+	case keyEnter:
+		t.button()
+		return
+	case keySave:
+		t.saveProfile()
+		return
+	}
+
+	switch f.kind {
+	case fieldText:
+		switch k.code {
+		case keyRune:
+			*f.text += string(k.r)
+		case keyBackspace:
+			if _, size := utf8.DecodeLastRuneInString(*f.text); size > 0 {
+				*f.text = (*f.text)[:len(*f.text)-size]
+			}
+		case keyClear:
+			*f.text = ""
+		}
+		if f.mask {
+			// edited, not the one wiped any more
+			c.passwdKept = false
+		}
+	case fieldCheck:
+		if k.code == keyRune && k.r == ' ' {
+			*f.check = !*f.check
+		}
+	case fieldAuth:
+		sel := 0
+		for i, a := range authChoices {
+			if a == c.authType {
+				sel = i
+			}
+		}
+		switch {
+		case k.code == keyRight, k.code == keyRune && k.r == ' ':
+			sel = (sel + 1) % len(authChoices)
+		case k.code == keyLeft:
+			sel = (sel + len(authChoices) - 1) % len(authChoices)
+		}
+		c.authType = authChoices[sel]
+	case fieldConns:
+		switch {
+		case k.code == keyRight, k.code == keyRune && k.r == '+':
+			c.maxConn++
+		case k.code == keyLeft, k.code == keyRune && k.r == '-':
+			c.maxConn--
+		}
+	case fieldButton:
+		if k.code == keyRune && k.r == ' ' {
+			t.button()
+		}
+	case fieldProfile:
+		// (new) and the profiles
+		sel := 0
+		for i, p := range c.profiles {
+			if p.Name == c.profile {
+				sel = i + 1
+			}
+		}
+		n := len(c.profiles) + 1
+		switch {
+		case k.code == keyRight, k.code == keyRune && k.r == ' ':
+			sel = (sel + 1) % n
+		case k.code == keyLeft:
+			sel = (sel + n - 1) % n
+		default:
+			return
+		}
+		if sel == 0 {
+			c.profile = ""
+		} else {
+			c.fromProfile(c.profiles[sel-1])
+			c.loadSecretsLater(c.profile)
+		}
+	}
+	// as the property of uiFn limits it
+	c.limitConns()
+}
+
+// button connects or disconnects, as the button of uiFn
+func (t *tui) button() {
+	c := t.c
+	switch c.connState {
+	case nConnected, nReconnecting:
+		if c.cancel != nil {
+			// startConnect closes all and sets nDisconnected
+			c.err = eNone
+			c.cancel()
+			c.cancel = nil
+		}
+	case nDisconnected:
+		if c.host == "" || (!c.anonymous && (c.usr == "" || !c.hasCredential())) {
+			t.msg = "You must set necessary information"
+			return
+		}
+		c.connect()
+	}
+}
+
+// saveProfile saves the form as the profile picked, or a new one named
+// after the host, as the Save button of uiFn
+func (t *tui) saveProfile() {
+	c := t.c
+	p := c.toProfile(c.profile)
+	if p.Name == "" {
+		p.Name = p.Host
+	}
+	if p.Name == "" {
+		t.msg = "Set the host to save a profile"
+		return
+	}
+	if err := c.saveAsProfile(p.Name); err != nil {
+		t.msg = err.Error()
+		return
+	}
+	c.profile = p.Name
+	c.profiles, _ = loadProfiles()
+	t.msg = "Saved profile " + p.Name
+}
+
+// tick updates the rates of traffic
+func (t *tui) tick() {
+	s := t.c.traffic
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	cur := trafficStats{
+		sentBytes:  atomic.LoadUint64(&s.sentBytes),
+		recvBytes:  atomic.LoadUint64(&s.recvBytes),
+		sentFrames: atomic.LoadUint64(&s.sentFrames),
+		recvFrames: atomic.LoadUint64(&s.recvFrames),
+	}
+	if s != t.stats {
+		// connected again
+		t.stats, t.last = s, trafficStats{}
+	}
+	if secs := now.Sub(t.lastTime).Seconds(); secs > 0 {
+		t.rates[0] = float64(cur.sentBytes-t.last.sentBytes) / secs
+		t.rates[1] = float64(cur.recvBytes-t.last.recvBytes) / secs
+	}
+	t.last, t.lastTime = cur, now
+}
+
+// draw draws the whole screen
+func (t *tui) draw() {
+	c := t.c
+	var b strings.Builder
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, format, args...)
+		b.WriteString("\x1b[K\r\n")
+	}
+	b.WriteString(ansiClear)
+	line("  %sSoftEtherVPN%s", ansiBold, ansiReset)
+	line("")
+
+	color := ansiRed
+	switch c.connState {
+	case nConnected:
+		color = ansiGreen
+	case nConnecting, nReconnecting:
+		color = ansiYellow
+	}
+	line("  %-14s%s%s%s", "Status:", color, c.status(), ansiReset)
+	line("")
+
+	if u := c.untrusted; u != nil {
+		// ask only once for each failed connection
+		c.untrusted = nil
+		t.trust = u
+	}
+	if u := t.trust; u != nil {
+		if u.Changed {
+			line("  %sWARNING: the certificate has CHANGED!%s", ansiRed, ansiReset)
+		} else {
+			line("  The certificate is not trusted yet.")
+		}
+		line("  Subject: %s", u.Cert.Subject.CommonName)
+		line("  Issuer:  %s", u.Cert.Issuer.CommonName)
+		line("  Valid:   %s to %s", u.Cert.NotBefore.Format("2006-01-02"), u.Cert.NotAfter.Format("2006-01-02"))
+		line("  SHA-256 fingerprint:")
+		line("  %s", u.Fingerprint)
+		line("")
+		line("  Trust it and connect? [y/n]")
+		os.Stdout.WriteString(b.String())
+		return
+	}
+
+	fields := t.fields()
+	if t.cur >= len(fields) {
+		t.cur = len(fields) - 1
+	}
+	for i, f := range fields {
+		var value string
+		switch f.kind {
+		case fieldText:
+			value = *f.text
+			if f.mask {
+				value = strings.Repeat("*", utf8.RuneCountInString(value))
+			}
+			value = fmt.Sprintf("%-30s", value)
+		case fieldCheck:
+			value = "[ ] " + f.label
+			if *f.check {
+				value = "[x] " + f.label
+			}
+		case fieldAuth:
+			for j, a := range authChoices {
+				if a == c.authType {
+					value = "< " + authNames[j] + " >"
+				}
+			}
+		case fieldConns:
+			value = "< " + strconv.Itoa(c.maxConn) + " >"
+		case fieldProfile:
+			value = "< (new) >"
+			if c.profile != "" {
+				value = "< " + c.profile + " >"
+			}
+		case fieldButton:
+			switch c.connState {
+			case nConnected, nReconnecting:
+				value = "[ Disconnect ]"
+			case nConnecting:
+				value = "[ Connecting ]"
+			default:
+				value = "[  Connect   ]"
+			}
+		}
+		label := f.label + ":"
+		if f.kind == fieldCheck || f.kind == fieldButton {
+			label = ""
+		}
+		if i == t.cur {
+			value = ansiReverse + value + ansiReset
+		}
+		line("  %-14s%s", label, value)
+	}
+	line("")
+
+	// traffic panel
+	if s := c.traffic; s != nil && c.connState != nDisconnected {
+		line("  %-14s%s in %d frames, %s/s", "Sent:", formatBytes(float64(atomic.LoadUint64(&s.sentBytes))),
+			atomic.LoadUint64(&s.sentFrames), formatBytes(t.rates[0]))
+		line("  %-14s%s in %d frames, %s/s", "Received:", formatBytes(float64(atomic.LoadUint64(&s.recvBytes))),
+			atomic.LoadUint64(&s.recvFrames), formatBytes(t.rates[1]))
+	} else {
+		line("")
+		line("")
+	}
+	line("")
+	if t.msg != "" {
+		line("  %s%s%s", ansiRed, t.msg, ansiReset)
+	} else {
+		line("")
+	}
+	line("  Tab/arrows: move  Space: toggle  Enter: connect/disconnect")
+	line("  Ctrl-S: save profile  Ctrl-C: quit")
+	os.Stdout.WriteString(b.String())
+}
+
+// formatBytes is n bytes in B, KB, MB or GB
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return strconv.FormatFloat(n, 'f', 0, 64) + " " + units[i]
+	}
+	return strconv.FormatFloat(n, 'f', 1, 64) + " " + units[i]
+}
+
+// readKeys reads keys from the terminal in raw mode into keys, it is closed
+// when the terminal is
+func readKeys(in *os.File, keys chan<- tuiKey) {
+	defer close(keys)
+	buf := make([]byte, 64)
+	for {
+		n, err := in.Read(buf)
+		if err != nil {
+			return
+		}
+		for p := buf[:n]; len(p) > 0; {
+			var k tuiKey
+			size := 1
+			switch b := p[0]; {
+			case b == 0x1b && len(p) >= 3 && (p[1] == '[' || p[1] == 'O'):
+				size = 3
+				switch p[2] {
+				case 'A':
+					k.code = keyUp
+				case 'B':
+					k.code = keyDown
+				case 'C':
+					k.code = keyRight
+				case 'D':
+					k.code = keyLeft
+				case 'Z':
+					k.code = keyBackTab
+				default:
+					k.code = -1
+				}
+			case b == 0x03 || b == 0x11:
+				k.code = keyQuit
+			case b == 0x13:
+				k.code = keySave
+			case b == '\t':
+				k.code = keyTab
+			case b == '\r' || b == '\n':
+				k.code = keyEnter
+			case b == 0x7f || b == 0x08:
+				k.code = keyBackspace
+			case b == 0x15:
+				k.code = keyClear
+			case b < 0x20:
+				k.code = -1
+			default:
+				k.r, size = utf8.DecodeRune(p)
+			}
+			p = p[size:]
+			if k.code >= 0 {
+				keys <- k
+			}
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package udpaccel is the UDP acceleration channel of SoftEtherVPN, version 1.
+// Frames of a session go over UDP when it works both ways, so that TCP
+// carried in the tunnel doesn't suffer from retransmits of the TLS connection.
+// Keys and cookies of both sides are exchanged in the login packs.
+//
+// A packet is, all integers in big endian:
+//
+//	| IV (20) | cookie (4) | my tick (8) | your tick (8) | size (2) |
+//	| compressed (1) | data | padding | zeros (20) |
+//
+// Unless in plain text mode, everything after IV is encrypted by RC4 with
+// the key SHA-1(key of the sender | IV), the last 20 bytes of a packet are
+// the IV of the next one, and the zeros verify the key. In plain text mode
+// there is no IV, padding nor zeros. A packet of no data is a keep-alive.
+package udpaccel
+
+import (
+	"bytes"
+	"compress/zlib"
+	cryprand "crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Version is the version of UDP acceleration supported
+const Version = 1
+
+// KeySize is the size of keys of both sides
+const KeySize = 20
+
+const (
+	ivSize     = 20
+	verifySize = 20
+	headerSize = 4 + 8 + 8 + 2 + 1
+	maxPadding = 32
+
+	maxFrameSize = 1600 // MAX_PACKET_SIZE of SoftEtherVPN
+
+	// MaxPacketSize is the max size of a UDP packet
+	MaxPacketSize = maxFrameSize + ivSize + headerSize + maxPadding + verifySize
+)
+
+// Intervals of keep-alive, and the default timeout after which the channel is
+// not used until packets get thru again
+const (
+	KeepAliveMin   = time.Second
+	KeepAliveMax   = 3 * time.Second
+	DefaultTimeout = 3 * KeepAliveMax
+)
+
+// Params are what both sides agreed on in the login packs, of the side using
+// them: MyKey encrypts packets sent, YourKey decrypts packets received,
+// MyCookie is in packets received and YourCookie in packets sent.
+type Params struct {
+	MyKey      []byte
+	YourKey    []byte
+	MyCookie   uint32
+	YourCookie uint32
+	Plain      bool
+	// Timeout is DefaultTimeout if 0
+	Timeout time.Duration
+}
+
+// Accel sends and receives frames over conn with peer. Send and KeepAlive
+// may be called at the same time, Recv from one goroutine only.
+type Accel struct {
+	conn  net.PacketConn
+	peer  net.Addr
+	p     Params
+	start time.Time
+
+	sendMu sync.Mutex
+	nextIV [ivSize]byte
+	buf    [MaxPacketSize]byte
+
+	// ticks in ms since start, atomic
+	lastRecvYourTick uint64 // tick of the peer last received, echoed back
+	lastRecvMyTick   uint64 // tick of mine the peer last received
+}
+
+// New returns the channel with peer over conn
+func New(conn net.PacketConn, peer net.Addr, p Params) (*Accel, error) {
+	if !p.Plain && (len(p.MyKey) != KeySize || len(p.YourKey) != KeySize) {
+		return nil, errors.New("udpaccel: bad key size")
+	}
+	if p.Timeout == 0 {
+		p.Timeout = DefaultTimeout
+	}
+	a := &Accel{conn: conn, peer: peer, p: p, start: time.Now()}
+	if _, err := cryprand.Read(a.nextIV[:]); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// NewKey returns a random key to send in the login pack
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	_, err := cryprand.Read(key)
+	return key, err
+}
+
+// tick is never 0, which means none received
+func (a *Accel) tick() uint64 {
+	return uint64(time.Since(a.start)/time.Millisecond) + 1
+}
+
+// Ready tells if the peer received packets of mine recently, and so frames
+// may be sent by Send instead of the TLS connection
+func (a *Accel) Ready() bool {
+	echo := atomic.LoadUint64(&a.lastRecvMyTick)
+	return echo != 0 && time.Duration(a.tick()-echo)*time.Millisecond < a.p.Timeout
+}
+
+// Send sends frame in one packet
+func (a *Accel) Send(frame []byte) error {
+	if len(frame) > maxFrameSize {
+		return errors.New("udpaccel: frame too large")
+	}
+	a.sendMu.Lock()
+	defer a.sendMu.Unlock()
+
+	p := a.buf[:0]
+	if !a.p.Plain {
+		p = append(p, a.nextIV[:]...)
+	}
+	p = appendUint32(p, a.p.YourCookie)
+	p = appendUint64(p, a.tick())
+	p = appendUint64(p, atomic.LoadUint64(&a.lastRecvYourTick))
+	p = append(p, byte(len(frame)>>8), byte(len(frame)), 0)
+	p = append(p, frame...)
+	if !a.p.Plain {
+		// padding hides the size of frames, the zeros are to verify
+		p = append(p, make([]byte, rand.Intn(maxPadding)+verifySize)...)
+		cryptPacket(a.p.MyKey, p[:ivSize], p[ivSize:])
+		copy(a.nextIV[:], p[len(p)-ivSize:])
+	}
+	_, err := a.conn.WriteTo(p, a.peer)
+	return err
+}
+
+// KeepAlive sends a packet of no data, which is to be done every
+// KeepAliveMin to KeepAliveMax
+func (a *Accel) KeepAlive() error {
+	return a.Send(nil)
+}
+
+// NextKeepAlive is a random interval to the next keep-alive
+func NextKeepAlive() time.Duration {
+	return KeepAliveMin + time.Duration(rand.Int63n(int64(KeepAliveMax-KeepAliveMin)))
+}
+
+// Recv waits for the next frame, keep-alive and packets failing to verify
+// are skipped. The frame is only valid until the next call. An error means
+// conn is closed.
+func (a *Accel) Recv(buf []byte) ([]byte, error) {
+	for {
+		n, _, err := a.conn.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		frame, ok := a.open(buf[:n])
+		if ok && len(frame) > 0 {
+			return frame, nil
+		}
+	}
+}
+
+// open verifies and decrypts packet in place, ok is false if it isn't a
+// packet of the peer
+func (a *Accel) open(packet []byte) (frame []byte, ok bool) {
+	p := packet
+	if !a.p.Plain {
+		if len(p) < ivSize+headerSize+verifySize {
+			return nil, false
+		}
+		cryptPacket(a.p.YourKey, p[:ivSize], p[ivSize:])
+		p = p[ivSize:]
+		for _, b := range p[len(p)-verifySize:] {
+			if b != 0 {
+				return nil, false
+			}
+		}
+		p = p[:len(p)-verifySize]
+	}
+	if len(p) < headerSize || binary.BigEndian.Uint32(p) != a.p.MyCookie {
+		return nil, false
+	}
+	yourTick := binary.BigEndian.Uint64(p[4:])
+	myTick := binary.BigEndian.Uint64(p[12:])
+	size := int(binary.BigEndian.Uint16(p[20:]))
+	compressed := p[22] != 0
+	p = p[headerSize:]
+	if size > len(p) {
+		return nil, false
+	}
+	frame = p[:size]
+
+	storeMax(&a.lastRecvYourTick, yourTick)
+	if myTick <= a.tick() {
+		storeMax(&a.lastRecvMyTick, myTick)
+	}
+	if compressed && size > 0 {
+		zr, err := zlib.NewReader(bytes.NewReader(frame))
+		if err != nil {
+			return nil, false
+		}
+		// no more than a frame, however well it is compressed
+		if frame, err = ioutil.ReadAll(io.LimitReader(zr, maxFrameSize+1)); err != nil || len(frame) > maxFrameSize {
+			return nil, false
+		}
+	}
+	return frame, true
+}
+
+func storeMax(addr *uint64, v uint64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		if v <= old || atomic.CompareAndSwapUint64(addr, old, v) {
+			return
+		}
+	}
+}
+
+// cryptPacket encrypts or decrypts data by RC4 of key and iv
+func cryptPacket(key, iv, data []byte) {
+	h := sha1.New()
+	h.Write(key)
+	h.Write(iv)
+	c, _ := rc4.NewCipher(h.Sum(nil)) // key of 20 bytes is fine
+	c.XORKeyStream(data, data)
+}
+
+func appendUint32(p []byte, v uint32) []byte {
+	return append(p, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(p []byte, v uint64) []byte {
+	return appendUint32(appendUint32(p, uint32(v>>32)), uint32(v))
+}
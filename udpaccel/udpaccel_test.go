@@ -0,0 +1,172 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package udpaccel
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// keepAliveEvery is the keep-alive interval of tests, which don't wait for
+// NextKeepAlive
+const keepAliveEvery = 20 * time.Millisecond
+
+// loopback is both sides of UDP acceleration on the loopback interface, as
+// the login packs would set them up: srv echoes every frame received, and
+// the frames echoed to cli are sent to echoes. Both keep alive until their
+// conn is closed.
+type loopback struct {
+	srvConn, cliConn net.PacketConn
+	srv, cli         *Accel
+	echoes           chan []byte
+}
+
+func newLoopback(t *testing.T, plain bool, timeout time.Duration) *loopback {
+	l := &loopback{echoes: make(chan []byte, 16)}
+	var err error
+	if l.srvConn, err = net.ListenPacket("udp4", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if l.cliConn, err = net.ListenPacket("udp4", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	srvKey, _ := NewKey()
+	cliKey, _ := NewKey()
+	srvCookie, cliCookie := rand.Uint32(), rand.Uint32()
+	if l.srv, err = New(l.srvConn, l.cliConn.LocalAddr(), Params{
+		MyKey: srvKey, YourKey: cliKey, MyCookie: srvCookie, YourCookie: cliCookie,
+		Plain: plain, Timeout: timeout,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if l.cli, err = New(l.cliConn, l.srvConn.LocalAddr(), Params{
+		MyKey: cliKey, YourKey: srvKey, MyCookie: cliCookie, YourCookie: srvCookie,
+		Plain: plain, Timeout: timeout,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			frame, err := l.srv.Recv(buf)
+			if err != nil {
+				return
+			}
+			l.srv.Send(frame)
+		}
+	}()
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			frame, err := l.cli.Recv(buf)
+			if err != nil {
+				return
+			}
+			l.echoes <- append([]byte(nil), frame...)
+		}
+	}()
+	keepAlive := func(a *Accel) {
+		for a.KeepAlive() == nil {
+			time.Sleep(keepAliveEvery)
+		}
+	}
+	go keepAlive(l.srv)
+	go keepAlive(l.cli)
+	return l
+}
+
+func (l *loopback) close() {
+	l.srvConn.Close()
+	l.cliConn.Close()
+}
+
+// waitReady waits for cli to be ready as it is
+func (l *loopback) waitReady(t *testing.T, ready bool, timeout time.Duration) {
+	start := time.Now()
+	for l.cli.Ready() != ready {
+		if time.Since(start) > timeout {
+			t.Fatalf("client ready %v after %v", !ready, timeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	for _, plain := range []bool{false, true} {
+		l := newLoopback(t, plain, 0)
+		l.waitReady(t, true, time.Second)
+		for i := 0; i < 100; i++ {
+			frame := make([]byte, 1+rand.Intn(maxFrameSize))
+			rand.Read(frame)
+			if err := l.cli.Send(frame); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case echo := <-l.echoes:
+				if !bytes.Equal(echo, frame) {
+					t.Fatalf("plain %v: frame %d echoed wrong", plain, i)
+				}
+			case <-time.After(time.Second):
+				// loopback hardly drops a packet
+				t.Fatalf("plain %v: frame %d lost", plain, i)
+			}
+		}
+		if err := l.cli.Send(make([]byte, maxFrameSize+1)); err == nil {
+			t.Errorf("plain %v: frame over %d bytes sent", plain, maxFrameSize)
+		}
+		l.close()
+	}
+}
+
+// TestWrongPeer checks that packets of another key or cookie are dropped
+func TestWrongPeer(t *testing.T) {
+	l := newLoopback(t, false, 0)
+	defer l.close()
+	l.waitReady(t, true, time.Second)
+
+	otherKey, _ := NewKey()
+	for _, p := range []Params{
+		{MyKey: otherKey, YourKey: otherKey, YourCookie: l.srv.p.MyCookie},
+		{MyKey: l.cli.p.MyKey, YourKey: l.cli.p.YourKey, YourCookie: l.srv.p.MyCookie + 1},
+	} {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, _ := New(conn, l.srvConn.LocalAddr(), p)
+		other.Send([]byte("not of the client"))
+		conn.Close()
+	}
+	frame := []byte("of the client")
+	l.cli.Send(frame)
+	select {
+	case echo := <-l.echoes:
+		if !bytes.Equal(echo, frame) {
+			t.Fatalf("echoed %q", echo)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("frame lost")
+	}
+}
+
+// TestBlockedPeer checks that the client stops using UDP once the server
+// side is blocked, so that frames fall back to TCP
+func TestBlockedPeer(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	l := newLoopback(t, false, timeout)
+	defer l.close()
+	l.waitReady(t, true, time.Second)
+
+	l.srvConn.Close()
+	blocked := time.Now()
+	l.waitReady(t, false, 2*timeout)
+	if d := time.Since(blocked); d < timeout/2 {
+		t.Errorf("not ready %v after blocked, timeout %v", d, timeout)
+	}
+}
@@ -5,14 +5,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"image"
 	"image/color"
+	"os"
 	"strconv"
 	"strings"
-
-	"crypto/tls"
-	"github.com/songgao/water"
+	"time"
 
 	"github.com/aarzilli/nucular"
 	"github.com/aarzilli/nucular/label"
@@ -20,50 +22,117 @@ import (
 	nstyle "github.com/aarzilli/nucular/style"
 	_ "golang.org/x/mobile/app"
 	_ "golang.org/x/mobile/event/key"
+
+	"gosec/softether"
 )
 
 const (
 	uiWidth  = 380
-	uiHigh   = 200
+	uiHigh   = 444
 	errWidth = 300
 	errHigh  = 120
 
+	trustWidth = 360
+	trustHigh  = 260
+
 	rowHigh   = 22
 	sepHigh   = 2
 	col1Width = 90
 	col2Width = 255
+	showWidth = 60
 )
 const (
 	nDisconnected = iota
 	nConnecting
 	nConnected
+	nReconnecting
 )
 const (
 	eNone = iota
 	eConn
 	ePerm
 	ePsw
+	eCert
+	eUntrusted
+	ePin
 )
 
 type vpnSetting struct {
 	host   string
+	hub    string // empty for DEFAULT, or taken from usr as user@hub or hub\user
 	usr    string
 	passwd string
+	// passwd was wiped from the form once connected, or is being loaded,
+	// the secret saved with the profile is kept when saved again
+	passwdKept bool
+	// of a profile imported from a .vpn file, taken if passwd is empty
+	hashedPasswd []byte
+	// softether.AuthPassword, AuthPlainPassword or AuthCert
+	authType int
+	// login without credential, for hubs allowing anonymous users
+	anonymous bool
+	// for AuthCert, passwd is the passphrase of the key
+	certFile string // PEM, or PKCS#12 with keyFile empty
+	keyFile  string // PEM
+	// server certificate is verified by pins if any, or else by caFile,
+	// the system roots if empty, or trusted by the user on first use
+	caFile    string
+	pins      []string // SHA-256 fingerprints
+	untrusted *softether.UntrustedCert
+	// TCP connections of the session wanted, the server may allow less
+	maxConn int
+	// half connection: each connection either uploads or downloads, the
+	// split is counted when connected
+	halfConn bool
+	// ask for compression of frames
+	compress bool
+	// offer UDP acceleration
+	udpAccel bool
+	// interval of keep-alive and timeout of the tunnel, 0 for the server's
+	keepAlive, keepAliveTimeout time.Duration
 
 	hostEditor   nucular.TextEditor
+	hubEditor    nucular.TextEditor
 	usrEditor    nucular.TextEditor
 	passwdEditor nucular.TextEditor
+	certEditor   nucular.TextEditor
+	keyEditor    nucular.TextEditor
 	curEditor    *nucular.TextEditor
-
-	chanQuit  chan struct{}
-	conn      *tls.Conn
-	ifce      *water.Interface
+	// passwdEditor shows the password as is
+	showPasswd bool
+
+	// cancels the connection started by connect
+	cancel context.CancelFunc
+	// session connected, attempt of reconnecting after it was lost
+	sess      *softether.Session
+	attempt   int
 	connState int
 	err       int
 	mw        *nucular.MasterWindow
+	// called when the state changes, from the goroutine of startConnect
+	onChange func()
+	// closed when startConnect returns
+	done chan struct{}
+	// of the TAP interface, since connected
+	traffic *trafficStats
+	// profiles saved, the one picked if any
+	profiles []profile
+	profile  string
+	// secrets of a profile picked, loaded in the background
+	loaded chan loadedSecrets
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "connect":
+			os.Exit(cliMain(os.Args[2:]))
+		case "import":
+			os.Exit(importMain(os.Args[2:]))
+		case "export":
+			os.Exit(exportMain(os.Args[2:]))
+		}
+	}
 	//app.Main(func(a app.App) {
 	defer func() {
 		if logFd != nil {
@@ -75,80 +144,234 @@ func main() {
 	var scaling = 1.2
 	var vpnDiag vpnSetting
 
-	var debugOpt = flag.String("debug", "no", "1. no - no debug\n2. print - print to console"+
-		"\n3. log - write log\n4. logserver host:port - write to logserver\n")
-
-	var hostport = flag.String("host", "localhost:4433", "host:port when debug set to logserver")
-
+	var tui = flag.Bool("tui", false, "text UI in the terminal, instead of the window")
+	applyDebug := debugFlags(flag.CommandLine, "host")
+	applySettings := vpnDiag.settingFlags(flag.CommandLine)
 	flag.Parse()
-	switch *debugOpt {
-
-	case "print":
-		Debug = fmtPrintf
-	case "log":
-		Debug = logPrintf
-	case "logserver":
-		Debug = sendToLogServer
-		logServer = *hostport
-	default:
-		Debug = nullPrintf
+	applyDebug()
+	if err := applySettings(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *tui {
+		if err := vpnDiag.runTUI(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			closeLogFd()
+			os.Exit(1)
+		}
+		return
 	}
 
 	wnd = nucular.NewMasterWindowSize(0, "SoftEtherVPN", image.Point{uiWidth, uiHigh}, vpnDiag.uiFn)
 	vpnDiag.mw = &wnd
+	vpnDiag.onChange = wnd.Changed
 
 	wnd.SetStyle(nstyle.FromTheme(theme, scaling))
 	wnd.Main()
 	//})
 }
 
+// debugFlags defines the flags of debug output on fs, with the log server
+// address by the flag named host, apply sets Debug after fs is parsed
+func debugFlags(fs *flag.FlagSet, host string) (apply func()) {
+	var debugOpt = fs.String("debug", "no", "1. no - no debug\n2. print - print to console"+
+		"\n3. log - write log\n4. logserver host:port - write to logserver\n")
+
+	var hostport = fs.String(host, "localhost:4433", "host:port when debug set to logserver")
+	var logCA = fs.String("logca", "", "CA bundle in PEM to verify logserver certificate")
+	var logPin = fs.String("logpin", "", "SHA-256 fingerprint of logserver certificate")
+
+	return func() {
+		logTrust.CAFile = *logCA
+		if *logPin != "" {
+			logTrust.Pins = []string{*logPin}
+		}
+		switch *debugOpt {
+
+		case "print":
+			Debug = fmtPrintf
+		case "log":
+			Debug = logPrintf
+		case "logserver":
+			Debug = sendToLogServer
+			logServer = *hostport
+		default:
+			Debug = nullPrintf
+		}
+		softether.Debug = Debug
+	}
+}
+
+// settingFlags defines the flags of connection settings on fs, apply sets
+// them to c after fs is parsed, over the profile given by -profile
+func (c *vpnSetting) settingFlags(fs *flag.FlagSet) (apply func() error) {
+	var profileName = fs.String("profile", "", "connection profile saved in "+profilesPath()+", flags given override it")
+	var auth = fs.String("auth", "", "auth type: password, plain or cert, cert if -cert is given and password otherwise")
+	var certFile = fs.String("cert", "", "client certificate for certificate auth, PEM or PKCS#12 (.p12/.pfx)")
+	var keyFile = fs.String("key", "", "private key of -cert in PEM, not needed for PKCS#12")
+	var hub = fs.String("hub", "", "virtual hub to login, DEFAULT if not set and no user@hub or hub\\user given")
+	var caFile = fs.String("ca", "", "CA bundle in PEM to verify server certificate, instead of system roots")
+	var pins = fs.String("pin", "", "SHA-256 fingerprints of trusted server certificates, separated by ','")
+	var maxConn = fs.Int("conns", 1, "number of TCP connections of the session, up to 32")
+	var halfConn = fs.Bool("half", false, "half-duplex, each connection one way, with -conns 2 at least")
+	var compress = fs.Bool("compress", false, "compress frames by zlib, if the server accepts")
+	var udpAccel = fs.Bool("udp", false, "UDP acceleration, frames over UDP when it gets thru, TCP otherwise")
+	var keepAlive = fs.Duration("keepalive", softether.DefaultKeepAlive, "interval of keep-alive, shorter if the server times out sooner")
+	var keepAliveTimeout = fs.Duration("timeout", 0, "reconnect when nothing is received for it, the server's timeout if 0")
+	var anonymous = fs.Bool("anonymous", false, "login as anonymous user, no password needed")
+
+	return func() error {
+		c.profiles, _ = loadProfiles()
+		set := func(string) bool { return true }
+		if *profileName != "" {
+			p, err := findProfile(*profileName)
+			if err != nil {
+				return err
+			}
+			c.fromProfile(p)
+			given := map[string]bool{}
+			fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+			set = func(name string) bool { return given[name] }
+		}
+		if set("cert") {
+			c.authType = softether.AuthPassword
+			if *certFile != "" {
+				c.authType = softether.AuthCert
+				c.certFile = *certFile
+			}
+		}
+		if set("auth") && *auth != "" {
+			known := false
+			for authType, name := range profileAuths {
+				if *auth == name {
+					c.authType = authType
+					known = true
+				}
+			}
+			if !known {
+				return fmt.Errorf("unknown -auth %q, password, plain or cert", *auth)
+			}
+			if c.authType == softether.AuthCert && c.certFile == "" {
+				return errors.New("-auth cert needs a client certificate by -cert")
+			}
+		}
+		if *profileName != "" {
+			// the secrets of the auth type given
+			c.loadSecrets(c.profile)
+		}
+		if set("key") {
+			c.keyFile = *keyFile
+		}
+		if set("anonymous") {
+			c.anonymous = *anonymous
+		}
+		if set("hub") {
+			c.hub = *hub
+		}
+		if set("conns") {
+			c.maxConn = *maxConn
+		}
+		if set("half") {
+			c.halfConn = *halfConn
+		}
+		if set("compress") {
+			c.compress = *compress
+		}
+		if set("udp") {
+			c.udpAccel = *udpAccel
+		}
+		if set("keepalive") {
+			c.keepAlive = *keepAlive
+		}
+		if set("timeout") {
+			c.keepAliveTimeout = *keepAliveTimeout
+		}
+		if set("ca") {
+			c.caFile = *caFile
+		}
+		if set("pin") && *pins != "" {
+			c.pins = strings.Split(*pins, ",")
+		}
+		c.limitConns()
+		return checkKeepAlive(c.keepAlive, c.keepAliveTimeout)
+	}
+}
+
+// checkKeepAlive rejects a timeout of the tunnel the keep-alives sent at
+// interval can't beat, every session would be taken as lost
+func checkKeepAlive(interval, timeout time.Duration) error {
+	if interval < 0 || timeout < 0 {
+		return errors.New("negative keep-alive interval or timeout")
+	}
+	if interval == 0 {
+		interval = softether.DefaultKeepAlive
+	}
+	if timeout != 0 && timeout <= interval {
+		return fmt.Errorf("timeout %v not over the keep-alive interval %v", timeout, interval)
+	}
+	return nil
+}
+
+// limitConns keeps maxConn in what SoftEtherVPN allows, 2 at least for a
+// half connection
+func (c *vpnSetting) limitConns() {
+	minConn := 1
+	if c.halfConn {
+		minConn = 2
+	}
+	if c.maxConn < minConn {
+		c.maxConn = minConn
+	} else if c.maxConn > softether.MaxConnections {
+		c.maxConn = softether.MaxConnections
+	}
+}
+
 func (c *vpnSetting) uiFn(w *nucular.Window) {
 	var isTab, isEnter bool
 
 	w.Row(10).Static(col1Width, col2Width)
 
+	c.applySecrets()
+	if c.connState == nConnected {
+		c.forgetPasswd()
+	}
+
 	w.Row(sepHigh).Static(col1Width, col2Width)
 	w.Row(rowHigh).Static(col1Width, col2Width)
 	w.Label("  Status:", "CC")
 
 	switch c.connState {
 	case nConnected:
-		w.LabelColored("SoftEtherVPN is connected", "LC", color.RGBA{0x27, 0xB5, 0x17, 0xff})
-	case nConnecting:
-		w.LabelColored("SoftEtherVPN is connecting ...", "LC", color.RGBA{0xff, 0xff, 0x00, 0xff})
+		w.LabelColored(c.status(), "LC", color.RGBA{0x27, 0xB5, 0x17, 0xff})
+	case nConnecting, nReconnecting:
+		w.LabelColored(c.status(), "LC", color.RGBA{0xff, 0xff, 0x00, 0xff})
 	case nDisconnected:
-		switch c.err {
-		case eNone:
-			w.LabelColored("SoftEtherVPN is disconnected", "LC", color.RGBA{0xff, 0x00, 0x00, 0xff})
-		case ePsw:
-			w.LabelColored("User name or password error", "LC", color.RGBA{0xff, 0x00, 0x00, 0xff})
-		case ePerm:
-			w.LabelColored("Re-run with root permission", "LC", color.RGBA{0xff, 0x00, 0x00, 0xff})
-		case eConn:
-			w.LabelColored("Failed to connect to server", "LC", color.RGBA{0xff, 0x00, 0x00, 0xff})
-		default:
-			w.LabelColored("Unknown error:"+strconv.Itoa(c.err), "LC", color.RGBA{0xff, 0x00, 0x00, 0xff})
-		}
+		w.LabelColored(c.status(), "LC", color.RGBA{0xff, 0x00, 0x00, 0xff})
 	default:
 		Debug("unknown connState")
 		return
 
 	}
 
+	if u := c.untrusted; u != nil {
+		// ask only once for each failed connection
+		c.untrusted = nil
+		w.Master().PopupOpen("Server certificate", nucular.WindowBorder|nucular.WindowMovable|nucular.WindowTitle, rect.Rect{(uiWidth - trustWidth) / 2, (uiHigh - trustHigh) / 2, trustWidth, trustHigh}, true, c.trustPopup(u))
+	}
+
 	if w.Input().Keyboard.Pressed(43) { // code can't use vender
 		Debug("Key tab pressed\n")
 		isTab = true
 
-		switch c.curEditor {
-		case &c.hostEditor:
-			c.curEditor = &c.usrEditor
-		case &c.usrEditor:
-			c.curEditor = &c.passwdEditor
-		case &c.passwdEditor:
-			c.curEditor = &c.hostEditor
-		default:
-			c.curEditor = &c.hostEditor
+		// next editor in the form, from the first if none
+		editors := c.editors()
+		next := editors[0]
+		for i, ed := range editors {
+			if ed == c.curEditor && i+1 < len(editors) {
+				next = editors[i+1]
+			}
 		}
+		c.curEditor = next
 
 		(*c.mw).ActivateEditor(c.curEditor)
 	} else if w.Input().Keyboard.Pressed(40) {
@@ -158,59 +381,64 @@ func (c *vpnSetting) uiFn(w *nucular.Window) {
 	}
 
 	w.Row(sepHigh).Static(col1Width, col2Width)
+	c.profileRow(w)
 
-	w.Row(rowHigh).Static(col1Width, col2Width)
-	w.Label("   HostName:", "LC")
-	c.hostEditor.Flags = nucular.EditField
-	c.hostEditor.Filter = nucular.FilterDefault
-	c.hostEditor.Maxlen = 255
-	c.hostEditor.Buffer = []rune(c.host)
-	c.hostEditor.Edit(w)
-	if !isTab {
-		c.host = string(c.hostEditor.Buffer)
+	w.Row(sepHigh).Static(col1Width, col2Width)
+	c.editRow(w, "   HostName:", &c.hostEditor, &c.host, isTab)
 
-	}
+	w.Row(sepHigh).Static(col1Width, col2Width)
+	c.editRow(w, "   HubName:", &c.hubEditor, &c.hub, isTab)
+
+	w.Row(sepHigh).Static(col1Width, col2Width)
+	c.editRow(w, "   UserName:", &c.usrEditor, &c.usr, isTab)
 
 	w.Row(sepHigh).Static(col1Width, col2Width)
 	w.Row(rowHigh).Static(col1Width, col2Width)
-	w.Label("   UserName:", "LC")
-	c.usrEditor.Flags = nucular.EditField
-	c.usrEditor.Filter = nucular.FilterDefault
-	c.usrEditor.Maxlen = 255
-	c.usrEditor.Buffer = []rune(c.usr)
-	c.usrEditor.Edit(w)
-	if !isTab {
-		c.usr = string(c.usrEditor.Buffer)
+	w.Label("", "LC")
+	w.CheckboxText("Anonymous", &c.anonymous)
+
+	if !c.anonymous {
+		w.Row(sepHigh).Static(col1Width, col2Width)
+		if c.authType == softether.AuthCert {
+			c.passwdRow(w, "   Passphrase:", isTab)
+		} else {
+			c.passwdRow(w, "   Password:", isTab)
+		}
 
+		w.Row(sepHigh).Static(col1Width, col2Width)
+		w.Row(rowHigh).Static(col1Width, col2Width)
+		w.Label("   Auth:", "LC")
+		sel := 0
+		for i, a := range authChoices {
+			if a == c.authType {
+				sel = i
+			}
+		}
+		c.authType = authChoices[w.ComboSimple(authNames, sel, rowHigh)]
+
+		if c.authType == softether.AuthCert {
+			w.Row(sepHigh).Static(col1Width, col2Width)
+			c.editRow(w, "   Cert file:", &c.certEditor, &c.certFile, isTab)
+			w.Row(sepHigh).Static(col1Width, col2Width)
+			c.editRow(w, "   Key file:", &c.keyEditor, &c.keyFile, isTab)
+		}
 	}
 
 	w.Row(sepHigh).Static(col1Width, col2Width)
-	w.Row(rowHigh).Static(col1Width, col2Width)
-	w.Label("   Password:", "LC")
-	c.passwdEditor.Flags = nucular.EditField
-	c.passwdEditor.Filter = nucular.FilterDefault
-	c.passwdEditor.Maxlen = 255
-	c.passwdEditor.Buffer = []rune(strings.Repeat("*", len(c.passwd)))
-	c.passwdEditor.Edit(w)
-	if !isTab {
-		//Here mimic password input box, no support to edit input midst, append only
-		tmpPwd := string(c.passwdEditor.Buffer)
-		lenTmpPwd := len(tmpPwd)
-		lenCPwd := len(c.passwd)
-		//Debug("tmpPass is %v\n",tmpPwd)
-		if lenTmpPwd < lenCPwd { // backspace
-			c.passwd = c.passwd[0:lenTmpPwd]
-		} else if lenTmpPwd == (lenCPwd+1) && tmpPwd[lenTmpPwd-1] == '*' { // append a "*"
-			c.passwd += "*"
-		} else if p := strings.LastIndex(tmpPwd, "*"); p != -1 { // append new
-			c.passwd += tmpPwd[p+1:]
-			//Debug("tmpPwd[p:] is %v\n",tmpPwd[p:])
-		} else { //first one
-			c.passwd = tmpPwd
-		}
+	w.Row(rowHigh).Static(col1Width, col2Width/2, col2Width/2)
+	w.Label("   Connections:", "LC")
+	minConn := 1
+	if c.halfConn {
+		minConn = 2
 	}
+	w.PropertyInt("#", minConn, &c.maxConn, softether.MaxConnections, 1, 1)
+	w.CheckboxText("Half-duplex", &c.halfConn)
 
-	//Debug("passwd is %v\n",c.passwd)
+	w.Row(sepHigh).Static(col1Width, col2Width)
+	w.Row(rowHigh).Static(col1Width, col2Width/2, col2Width/2)
+	w.Label("", "LC")
+	w.CheckboxText("Compress", &c.compress)
+	w.CheckboxText("UDP accel", &c.udpAccel)
 
 	w.Row(sepHigh).Static(col1Width, col2Width)
 	w.Row(rowHigh).Static(col1Width, 80)
@@ -219,25 +447,23 @@ func (c *vpnSetting) uiFn(w *nucular.Window) {
 	//Debug("host is %v\n",c.host)
 	switch c.connState {
 
-	case nConnected:
-		if w.Button(label.T("Disconnect"), false) || isEnter {
-			c.ifce.Close()
-			c.conn.Close()
-			c.connState = nDisconnected
+	case nConnected, nReconnecting:
+		if (w.Button(label.T("Disconnect"), false) || isEnter) && c.cancel != nil {
+			// startConnect closes all and sets nDisconnected
 			c.err = 0
-			c.chanQuit <- struct{}{}
+			c.cancel()
+			c.cancel = nil
 		}
 
 	case nDisconnected:
 		if w.Button(label.T("Connect"), false) || isEnter {
-			if c.host == "" || c.usr == "" || c.passwd == "" {
+			if c.host == "" || (!c.anonymous && (c.usr == "" || !c.hasCredential())) {
 				w.Master().PopupOpen("Error", nucular.WindowBorder|nucular.WindowMovable|nucular.WindowTitle, rect.Rect{(uiWidth - errWidth) / 2, (uiHigh - errHigh) / 2, errWidth, errHigh}, true, c.errorSettingPopup)
 
 				return
 			}
 			Debug("button pressed!\n")
-			c.connState = nConnecting
-			go c.startConnect()
+			c.connect()
 		}
 
 	case nConnecting:
@@ -256,3 +482,263 @@ func (c *vpnSetting) errorSettingPopup(w *nucular.Window) {
 		w.Close()
 	}
 }
+
+// connect starts connecting in background, Disconnect cancels it
+func (c *vpnSetting) connect() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.connState = nConnecting
+	done := make(chan struct{})
+	c.done = done
+	go func() {
+		c.startConnect(ctx)
+		close(done)
+	}()
+}
+
+// status tells the state of the connection, or why it failed
+func (c *vpnSetting) status() string {
+	switch c.connState {
+	case nConnected:
+		return c.connectedStatus()
+	case nConnecting:
+		return "SoftEtherVPN is connecting ..."
+	case nReconnecting:
+		return "Reconnecting (attempt " + strconv.Itoa(c.attempt) + ")"
+	}
+	switch c.err {
+	case eNone:
+		return "SoftEtherVPN is disconnected"
+	case ePsw:
+		return "User name or password error"
+	case ePerm:
+		return "Re-run with root permission"
+	case eConn:
+		return "Failed to connect to server"
+	case eCert:
+		return "Can't load certificate or key"
+	case eUntrusted:
+		return "Server certificate not trusted"
+	case ePin:
+		return "Server certificate not pinned"
+	}
+	return "Unknown error:" + strconv.Itoa(c.err)
+}
+
+// changed tells the front-end the state changed
+func (c *vpnSetting) changed() {
+	if c.onChange != nil {
+		c.onChange()
+	}
+}
+
+// connectedStatus tells the server connected and how
+func (c *vpnSetting) connectedStatus() string {
+	s := c.sess
+	if s == nil {
+		return "SoftEtherVPN is connected"
+	}
+	status := "SoftEtherVPN is connected"
+	if s.Server() != softether.HostPort(c.host) {
+		status = "Connected to member " + s.Server()
+	}
+	if up, down := s.Directions(); up > 0 {
+		status += " (" + strconv.Itoa(up) + " up / " + strconv.Itoa(down) + " down)"
+	} else if s.Conns() > 1 {
+		status += " (" + strconv.Itoa(s.Conns()) + " conns)"
+	}
+	if s.UDPReady() {
+		status += ", UDP"
+	}
+	if ratio, ok := s.CompressRatio(); ok {
+		status += ", zlib " + strconv.FormatFloat(ratio, 'f', 1, 64) + "x"
+	}
+	return status
+}
+
+// authChoices are the auth types in the order of authNames
+var authChoices = []int{softether.AuthPassword, softether.AuthPlainPassword, softether.AuthCert}
+var authNames = []string{"Password", "Plain password (RADIUS / NT)", "Certificate"}
+
+// editors returns the editors of the form in tab order
+func (c *vpnSetting) editors() []*nucular.TextEditor {
+	editors := []*nucular.TextEditor{&c.hostEditor, &c.hubEditor, &c.usrEditor}
+	if c.anonymous {
+		return editors
+	}
+	editors = append(editors, &c.passwdEditor)
+	if c.authType == softether.AuthCert {
+		editors = append(editors, &c.certEditor, &c.keyEditor)
+	}
+	return editors
+}
+
+// profileRow shows the profiles to pick one, and saves the form as the one
+// picked, or a new one named after the host
+func (c *vpnSetting) profileRow(w *nucular.Window) {
+	w.Row(rowHigh).Static(col1Width, col2Width/2, col2Width/2)
+	w.Label("   Profile:", "LC")
+	names := []string{"(new)"}
+	sel := 0
+	for i, p := range c.profiles {
+		names = append(names, p.Name)
+		if p.Name == c.profile {
+			sel = i + 1
+		}
+	}
+	if picked := w.ComboSimple(names, sel, rowHigh); picked != sel {
+		if picked == 0 {
+			c.profile = ""
+		} else {
+			c.fromProfile(c.profiles[picked-1])
+			c.loadSecretsLater(c.profile)
+		}
+	}
+	if w.Button(label.T("Save"), false) {
+		p := c.toProfile(c.profile)
+		if p.Name == "" {
+			p.Name = p.Host
+		}
+		if p.Name == "" {
+			return
+		}
+		if err := c.saveAsProfile(p.Name); err != nil {
+			Debug("err: %v\n", err)
+			return
+		}
+		c.profile = p.Name
+		c.profiles, _ = loadProfiles()
+	}
+}
+
+// editRow shows a labeled one line editor of value
+func (c *vpnSetting) editRow(w *nucular.Window, name string, ed *nucular.TextEditor, value *string, isTab bool) {
+	w.Row(rowHigh).Static(col1Width, col2Width)
+	w.Label(name, "LC")
+	ed.Flags = nucular.EditField
+	ed.Filter = nucular.FilterDefault
+	ed.Maxlen = 255
+	ed.Buffer = []rune(*value)
+	ed.Edit(w)
+	if !isTab {
+		*value = string(ed.Buffer)
+	}
+}
+
+// passwdRow shows the editor of passwd, which holds its runes masked unless
+// Show is ticked. Copy and cut are ignored while masked, paste works.
+func (c *vpnSetting) passwdRow(w *nucular.Window, name string, isTab bool) {
+	ed := &c.passwdEditor
+	w.Row(rowHigh).Static(col1Width, col2Width-showWidth, showWidth)
+	w.Label(name, "LC")
+	ed.Flags = nucular.EditField
+	ed.Filter = nucular.FilterDefault
+	ed.Maxlen = 255
+	ed.PasswordChar = '*'
+	if c.showPasswd {
+		ed.PasswordChar = 0
+	}
+	if !sameRunes(ed.Buffer, c.passwd) {
+		// set by a profile, or wiped
+		wipeRunes(ed.Buffer)
+		ed.Buffer = []rune(c.passwd)
+		if ed.Cursor > len(ed.Buffer) {
+			ed.Cursor = len(ed.Buffer)
+		}
+		ed.SelectStart, ed.SelectEnd = ed.Cursor, ed.Cursor
+	}
+
+	kb := &w.Input().Keyboard
+	keys := kb.Keys
+	if !c.showPasswd {
+		kb.Keys = nil
+		for _, k := range keys {
+			// Ctrl-C and Ctrl-X, code can't use vender
+			if k.Modifiers == 2 && (k.Code == 6 || k.Code == 27) {
+				continue
+			}
+			kb.Keys = append(kb.Keys, k)
+		}
+	}
+	ed.Edit(w)
+	kb.Keys = keys
+
+	if !isTab && !sameRunes(ed.Buffer, c.passwd) {
+		c.passwd = string(ed.Buffer)
+		c.passwdKept = false
+	}
+	w.CheckboxText("Show", &c.showPasswd)
+}
+
+// forgetPasswd wipes the password of the form once connected, the client
+// keeps its own to login again
+func (c *vpnSetting) forgetPasswd() {
+	if c.passwd == "" && len(c.passwdEditor.Buffer) == 0 {
+		return
+	}
+	c.passwdKept = true
+	wipeRunes(c.passwdEditor.Buffer)
+	c.passwdEditor.Buffer = c.passwdEditor.Buffer[:0]
+	c.passwdEditor.Cursor = 0
+	c.passwdEditor.SelectStart, c.passwdEditor.SelectEnd = 0, 0
+	c.passwd = ""
+}
+
+// sameRunes tells if rs are the runes of s
+func sameRunes(rs []rune, s string) bool {
+	i := 0
+	for _, r := range s {
+		if i == len(rs) || rs[i] != r {
+			return false
+		}
+		i++
+	}
+	return i == len(rs)
+}
+
+func wipeRunes(rs []rune) {
+	for i := range rs {
+		rs[i] = 0
+	}
+}
+
+// hasCredential tells if the form has what authType needs besides user name
+func (c *vpnSetting) hasCredential() bool {
+	if c.authType == softether.AuthCert {
+		// key may be not encrypted, no passphrase
+		return c.certFile != ""
+	}
+	return c.passwd != "" || (c.authType == softether.AuthPassword && c.hashedPasswd != nil)
+}
+
+// trustPopup shows the untrusted server certificate, if the user trusts it
+// the fingerprint is remembered for the server and connect again
+func (c *vpnSetting) trustPopup(u *softether.UntrustedCert) func(*nucular.Window) {
+	return func(w *nucular.Window) {
+		w.Row(20).Dynamic(1)
+		if u.Changed {
+			w.LabelColored("WARNING: the certificate has CHANGED!", "LC", color.RGBA{0xff, 0x00, 0x00, 0xff})
+		} else {
+			w.Label("The certificate is not trusted yet.", "LC")
+		}
+		w.Label("Subject: "+u.Cert.Subject.CommonName, "LC")
+		w.Label("Issuer: "+u.Cert.Issuer.CommonName, "LC")
+		w.Label("Valid: "+u.Cert.NotBefore.Format("2006-01-02")+" to "+u.Cert.NotAfter.Format("2006-01-02"), "LC")
+		w.Label("SHA-256 fingerprint:", "LC")
+		// 32 bytes of "XX:" don't fit in one line
+		w.Label(u.Fingerprint[:47], "LC")
+		w.Label(u.Fingerprint[48:], "LC")
+		w.Row(25).Dynamic(2)
+		if w.Button(label.T("Trust"), false) {
+			if err := saveKnownServer(u.HostPort, u.Fingerprint); err != nil {
+				Debug("err: %v\n", err)
+			}
+			c.err = eNone
+			c.connect()
+			w.Close()
+		}
+		if w.Button(label.T("Cancel"), false) {
+			w.Close()
+		}
+	}
+}
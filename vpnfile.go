@@ -0,0 +1,146 @@
+// Copyright 2017-2019 ajee.cai@gmail.com. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gosec/softether"
+)
+
+// importMain runs "gosec import", which saves a .vpn file of the official
+// client as a profile. It returns the exit code.
+func importMain(args []string) int {
+	fs := flag.NewFlagSet("gosec import", flag.ContinueOnError)
+	var name = fs.String("name", "", "profile name, the account name of the file if not set")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gosec import [-name profile] file.vpn\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitConn
+	}
+	a, err := softether.ReadAccount(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+		return exitConn
+	}
+	if *name == "" {
+		*name = a.Name
+	}
+	if *name == "" {
+		*name = strings.TrimSuffix(filepath.Base(fs.Arg(0)), filepath.Ext(fs.Arg(0)))
+	}
+
+	c := vpnSetting{
+		host:         a.Host,
+		hub:          a.Hub,
+		usr:          a.User,
+		passwd:       a.Password,
+		hashedPasswd: a.HashedPassword,
+		authType:     a.AuthType,
+		anonymous:    a.Anonymous,
+		maxConn:      a.MaxConnections,
+		halfConn:     a.HalfConnection,
+		compress:     a.Compress,
+		udpAccel:     a.UDPAccel,
+		pins:         a.Pins,
+		keepAlive:    softether.DefaultKeepAlive,
+	}
+	c.limitConns()
+	if err := c.saveAsProfile(*name); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitConn
+	}
+	fmt.Printf("saved as profile %q in %s\n", *name, profilesPath())
+	if !a.UseEncrypt {
+		fmt.Println("note: UseEncrypt is off in the file, gosec always connects by SSL")
+	}
+	switch {
+	case a.Anonymous:
+	case a.AuthType == softether.AuthCert:
+		fmt.Println("note: the client certificate is not imported, give it by -cert and -key")
+	case a.Password == "" && a.HashedPassword == nil:
+		fmt.Println("note: no password in the file, it is asked when connecting")
+	default:
+		fmt.Printf("the password is kept in the %v\n", secrets())
+	}
+	return exitOK
+}
+
+// exportMain runs "gosec export", which writes a profile as a .vpn file the
+// official client imports. It returns the exit code.
+func exportMain(args []string) int {
+	fs := flag.NewFlagSet("gosec export", flag.ContinueOnError)
+	var name = fs.String("profile", "", "profile to export")
+	var out = fs.String("o", "", "file to write, stdout if not set")
+	var passwdFile = fs.String("password-file", "", "file of the password on its first line, else $"+passwordEnv+", else prompted")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gosec export -profile name [-o file.vpn]\n\n"+
+			"The password saved with the profile, or else asked for, is hashed into the file.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *name == "" || fs.NArg() != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	p, err := findProfile(*name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	var c vpnSetting
+	c.fromProfile(p)
+	c.loadSecrets(p.Name)
+	if c.authType == softether.AuthCert && !c.anonymous {
+		fmt.Fprintln(os.Stderr, "client certificate login can't be exported")
+		return exitUsage
+	}
+	if !c.anonymous && !c.hasCredential() {
+		if c.passwd, err = cliPassword(*passwdFile, false); err != nil {
+			fmt.Fprintln(os.Stderr, "password:", err)
+			return exitUsage
+		}
+	}
+
+	a := softether.Account{Name: c.profile, Config: c.config(), UseEncrypt: true}
+	if len(a.Pins) > 0 || a.CAFile != "" {
+		fmt.Fprintln(os.Stderr, "note: the pins and CA of the profile are not exported, the VPN Client Manager asks to trust the server certificate")
+	}
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitConn
+		}
+		defer f.Close()
+		w = f
+	}
+	if _, err := a.WriteTo(w); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitConn
+	}
+	return exitOK
+}